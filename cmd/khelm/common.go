@@ -7,12 +7,40 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
 	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/mgoltzsche/khelm/v2/pkg/helm"
+	"github.com/pkg/errors"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 func render(h *helm.Helm, req *config.ChartConfig) ([]*yaml.RNode, error) {
+	rendered, err := h.Render(signalContext(), req)
+	logUntrustedRepositoryHint(err)
+	return rendered, err
+}
+
+func logUntrustedRepositoryHint(err error) {
+	// A repository that is denied by a trust policy rule cannot be allowed using the other options
+	if helm.IsUntrustedRepository(err) && !helm.IsDeniedRepository(err) {
+		log.Printf("HINT: access to untrusted repositories can be enabled using env var %s=true or option --%s or allowed using a trust policy (%s or --%s)", envTrustAnyRepo, flagTrustAnyRepo, envTrustPolicy, flagTrustPolicy)
+	}
+}
+
+// traceValues locates the chart values that should be made configurable within the generated kustomization.
+func traceValues(h *helm.Helm, req *config.ChartConfig, cfg *config.KustomizationConfig) ([]resource.ValueUsage, error) {
+	if len(cfg.Values) == 0 {
+		return nil, nil
+	}
+	if cfg.ValuesConfigMap == "" {
+		cfg.ValuesConfigMap = req.Name + "-values"
+	}
+	return h.TraceValues(signalContext(), req, cfg.Values)
+}
+
+// signalContext returns a context that is cancelled when the process receives a termination signal.
+func signalContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -21,10 +49,27 @@ func render(h *helm.Helm, req *config.ChartConfig) ([]*yaml.RNode, error) {
 		log.Printf("Received %s signal", s)
 		cancel()
 	}()
+	return ctx
+}
 
-	rendered, err := h.Render(ctx, req)
-	if helm.IsUntrustedRepository(err) {
-		log.Printf("HINT: access to untrusted repositories can be enabled using env var %s=true or option --%s", envTrustAnyRepo, flagTrustAnyRepo)
+// keepTestHooks makes the chart's test hooks part of the output unless a hook policy is specified for them.
+// A policy that does not keep the test hooks conflicts with a separate tests output.
+func keepTestHooks(req *config.ChartConfig) error {
+	if req.Hooks.Policies == nil {
+		req.Hooks.Policies = map[string]string{}
 	}
-	return rendered, err
+	for _, hook := range config.TestHookTypes {
+		policy := req.Hooks.Policies[hook]
+		if policy == "" {
+			req.Hooks.Policies[hook] = config.HookPolicyKeep
+		} else if policy != config.HookPolicyKeep {
+			return errors.Errorf("hook policy %s=%s conflicts with the tests output which requires the test hooks to be kept", hook, policy)
+		}
+	}
+	return nil
+}
+
+// isTestHook returns true if the given resource is a chart test hook
+func isTestHook(meta *yaml.ResourceMeta) bool {
+	return config.IsTestHook(matcher.HookTypes(meta))
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -12,6 +11,7 @@ import (
 
 	"github.com/mgoltzsche/khelm/v2/internal/matcher"
 	"github.com/mgoltzsche/khelm/v2/internal/output"
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
 	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/mgoltzsche/khelm/v2/pkg/helm"
 	"github.com/pkg/errors"
@@ -48,6 +48,15 @@ func krmFnCommand(h *helm.Helm) *cobra.Command {
 		}
 		outputPaths := make([]string, len(fnCfg.OutputPathMapping)+1)
 		outputPaths[0] = outputPath
+		if fnCfg.TestsOutputPath != "" {
+			if fnCfg.TestsOutputPath == outputPath {
+				return errors.Errorf("testsOutputPath must differ from outputPath %q", outputPath)
+			}
+			outputPaths = append(outputPaths, fnCfg.TestsOutputPath)
+			if err := keepTestHooks(&fnCfg.ChartConfig); err != nil {
+				return err
+			}
+		}
 		for i, m := range fnCfg.OutputPathMapping {
 			outputPaths[i+1] = m.OutputPath
 			if m.OutputPath == "" {
@@ -60,17 +69,29 @@ func krmFnCommand(h *helm.Helm) *cobra.Command {
 
 		// Template the helm chart
 		h.Settings.Debug = h.Settings.Debug || fnCfg.Debug
+		if fnCfg.PreserveSource == "" && selectsSource(fnCfg.OutputPathMapping) {
+			// Keep the source template path to map resources by it
+			fnCfg.PreserveSource = config.PreserveSourceComment
+		}
 		rendered, err := render(h, &fnCfg.ChartConfig)
 		if err != nil {
 			return err
 		}
 
 		// Apply output path mappings and annotate resources
-		kustomizationDirs, err := mapOutputPaths(rendered, fnCfg.OutputPathMapping, outputPath, h.Settings.Debug)
+		kustomizationDirs, err := mapOutputPaths(rendered, fnCfg.OutputPathMapping, outputPath, fnCfg.TestsOutputPath, fnCfg.Kustomization.SplitCRDs, h.Settings.Debug)
 		if err != nil {
 			return err
 		}
 
+		var values []resource.ValueUsage
+		if len(kustomizationDirs) > 0 {
+			values, err = traceValues(h, &fnCfg.ChartConfig, &fnCfg.Kustomization)
+			if err != nil {
+				return err
+			}
+		}
+
 		// Generate kustomizations
 		dirs := make([]string, 0, len(kustomizationDirs))
 		for dir := range kustomizationDirs {
@@ -81,7 +102,18 @@ func krmFnCommand(h *helm.Helm) *cobra.Command {
 		for i, dir := range dirs {
 			resources := kustomizationDirs[dir]
 			kustomizationPath := path.Join(dir, "kustomization.yaml")
-			kustomization, err := generateKustomization(resources)
+			resourcePaths := resourceNames(resources, "")
+			kustomizationCfg := fnCfg.Kustomization
+			if fnCfg.Kustomization.SplitCRDs {
+				if crds, ok := kustomizationDirs[crdsDir(dir)]; ok {
+					resourcePaths = append([]string{output.CRDsDir}, resourcePaths...)
+					resources = append(append([]*yaml.RNode{}, resources...), crds...)
+				} else if _, ok := kustomizationDirs[path.Dir(path.Clean(dir))+"/"]; ok && path.Base(dir) == output.CRDsDir {
+					kustomizationCfg = config.KustomizationConfig{}
+					resources = nil
+				}
+			}
+			kustomization, err := output.NewKustomization(resourcePaths, kustomizationCfg, output.FilterValueUsages(values, resources))
 			if err != nil {
 				return errors.Wrapf(err, "generate %s", kustomizationPath)
 			}
@@ -159,18 +191,9 @@ func loadKRMFunctionConfig(rl *framework.ResourceList) (*config.KRMFuncConfig, e
 	return cfg, nil
 }
 
-func generateKustomization(resources []*yaml.RNode) (*yaml.RNode, error) {
-	resourcePaths := resourceNames(resources, "")
-	m := map[string]interface{}{
-		"apiVersion": "kustomize.config.k8s.io/v1beta1",
-		"kind":       "Kustomization",
-		"resources":  resourcePaths,
-	}
-	b, err := json.Marshal(m)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	return yaml.ConvertJSONToYamlNode(string(b))
+// crdsDir returns the kustomization directory the CRDs are split into for the given output directory.
+func crdsDir(dir string) string {
+	return path.Join(dir, output.CRDsDir) + "/"
 }
 
 func filterByOutputPath(resources []*yaml.RNode, outputPaths []string) []*yaml.RNode {
@@ -193,7 +216,7 @@ func isGeneratedOutputPath(path string, outputPaths []string) bool {
 	return false
 }
 
-func mapOutputPaths(resources []*yaml.RNode, outputMappings []config.KRMFuncOutputMapping, defaultOutputPath string, debug bool) (map[string][]*yaml.RNode, error) {
+func mapOutputPaths(resources []*yaml.RNode, outputMappings []config.KRMFuncOutputMapping, defaultOutputPath, testsOutputPath string, splitCRDs, debug bool) (map[string][]*yaml.RNode, error) {
 	matchers := make([]matcher.ResourceMatchers, len(outputMappings))
 	for i, m := range outputMappings {
 		matchers[i] = matcher.FromResourceSelectors(m.Selectors)
@@ -205,15 +228,31 @@ func mapOutputPaths(resources []*yaml.RNode, outputMappings []config.KRMFuncOutp
 			continue
 		}
 
+		if source := resource.SourceTemplate(o); source != "" {
+			if meta.Annotations == nil {
+				meta.Annotations = map[string]string{}
+			}
+			meta.Annotations[config.AnnotationSource] = source
+		}
 		outPath := defaultOutputPath
-		for i, m := range matchers {
-			if m.Match(&meta) {
-				outPath = outputMappings[i].OutputPath
-				break
+		if testsOutputPath != "" && isTestHook(&meta) {
+			outPath = testsOutputPath
+		} else {
+			for i, m := range matchers {
+				if m.Match(&meta) {
+					outPath = outputMappings[i].OutputPath
+					break
+				}
 			}
 		}
 
 		// Set kpt order and path annotations
+		if output.IsDirectory(outPath) && splitCRDs && output.IsCRD(o) {
+			if _, ok := kustomizationDirs[outPath]; !ok {
+				kustomizationDirs[outPath] = nil
+			}
+			outPath = crdsDir(outPath)
+		}
 		if output.IsDirectory(outPath) {
 			kustomizationDirs[outPath] = append(kustomizationDirs[outPath], o)
 			outPath = output.ResourcePath(meta, outPath)
@@ -234,6 +273,17 @@ func mapOutputPaths(resources []*yaml.RNode, outputMappings []config.KRMFuncOutp
 	return kustomizationDirs, nil
 }
 
+func selectsSource(outputMappings []config.KRMFuncOutputMapping) bool {
+	for _, m := range outputMappings {
+		for _, sel := range m.Selectors {
+			if sel.SelectsSource() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func setKptAnnotations(o *yaml.RNode, path string, index int, debug bool) error {
 	if debug {
 		m, err := o.GetMeta()
@@ -257,6 +257,36 @@ func TestKptFnCommand(t *testing.T) {
 				" myannotation: should-be-preserved\n",
 			},
 		},
+		{
+			"output path mapping by source",
+			config.KRMFuncConfig{
+				ChartConfig: config.ChartConfig{
+					LoaderConfig: config.LoaderConfig{
+						Chart: filepath.Join(exampleDir, "namespace"),
+					},
+				},
+				OutputPathMapping: []config.KRMFuncOutputMapping{{
+					OutputPath: "rbac.yaml",
+					Selectors:  []config.ResourceSelector{{Source: "namespace/templates/clusterrolebinding.yaml"}},
+				}},
+			},
+			3, []string{"\n    config.kubernetes.io/path: rbac.yaml\n  name: jenkins-role-binding\n"},
+		},
+		{
+			"tests output path",
+			config.KRMFuncConfig{
+				ChartConfig: config.ChartConfig{
+					LoaderConfig: config.LoaderConfig{
+						Chart: filepath.Join(exampleDir, "chart-hooks"),
+					},
+					RendererConfig: config.RendererConfig{
+						ExcludeHooks: true,
+					},
+				},
+				TestsOutputPath: "tests/chart-tests.yaml",
+			},
+			2, []string{"\n    config.kubernetes.io/path: tests/chart-tests.yaml\n    helm.sh/hook: test\n"},
+		},
 		{
 			"output kustomization",
 			config.KRMFuncConfig{
@@ -269,6 +299,48 @@ func TestKptFnCommand(t *testing.T) {
 			},
 			4, []string{"resources:\n- configmap_myconfiga.yaml\n- configmap_myconfigb.yaml\n"},
 		},
+		{
+			"output kustomization with split crds",
+			config.KRMFuncConfig{
+				ChartConfig: config.ChartConfig{
+					LoaderConfig: config.LoaderConfig{
+						Chart: filepath.Join(exampleDir, "crds"),
+					},
+				},
+				OutputPath: "my/output/path/",
+				Kustomization: config.KustomizationConfig{
+					Namespace:          "myns",
+					CommonLabels:       map[string]string{"team": "a"},
+					PatchesPlaceholder: true,
+					SplitCRDs:          true,
+				},
+			},
+			4, []string{
+				"apiVersion: kustomize.config.k8s.io/v1beta1\ncommonLabels:\n  team: a\nkind: Kustomization\n",
+				"    config.kubernetes.io/path: my/output/path/kustomization.yaml\nnamespace: myns\npatches: []\nresources:\n- crds\n- example_release-name-example.yaml\n",
+				"    config.kubernetes.io/path: my/output/path/crds/kustomization.yaml\nresources:\n- customresourcedefinition_examples.example.org.yaml\n",
+				"    config.kubernetes.io/path: my/output/path/crds/customresourcedefinition_examples.example.org.yaml\n",
+			},
+		},
+		{
+			"output kustomization with values",
+			config.KRMFuncConfig{
+				ChartConfig: config.ChartConfig{
+					LoaderConfig: config.LoaderConfig{
+						Chart: filepath.Join(exampleDir, "kustomization-values"),
+					},
+				},
+				OutputPath: "my/output/path/",
+				Kustomization: config.KustomizationConfig{
+					Values: []string{"replicaCount"},
+				},
+			},
+			2, []string{
+				"configMapGenerator:\n- literals:\n  - replicaCount=1\n  name: release-name-values\n",
+				"- source:\n    fieldPath: data.replicaCount\n    kind: ConfigMap\n    name: release-name-values\n",
+				"  - fieldPaths:\n    - spec.replicas\n",
+			},
+		},
 	} {
 		t.Run(c.name, func(t *testing.T) {
 			c.input.Debug = true
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/helm"
+	"github.com/spf13/cobra"
+)
+
+func imagesCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
+	chart := &chartFlags{}
+	cmd := &cobra.Command{
+		Use:     "images",
+		Args:    chartArgs,
+		Short:   "Lists the container images referenced by a chart's output",
+		Example: "  khelm images ./chart\n  khelm images cert-manager --repo=https://charts.jetstack.io --image=quay.io/jetstack/cert-manager-controller=registry.example.org/cert-manager-controller",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := chart.apply(h, cmd, args); err != nil {
+				return err
+			}
+			resources, err := render(h, &chart.ChartConfig)
+			if err != nil {
+				return err
+			}
+			images, err := helm.Images(resources)
+			if err != nil {
+				return err
+			}
+			for _, image := range images {
+				if _, err = fmt.Fprintln(writer, image); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		_ = cmd.Help()
+		return err
+	})
+	chart.addFlags(cmd.Flags())
+	return cmd
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImagesCommand(t *testing.T) {
+	var out bytes.Buffer
+	os.Args = []string{"testee", "images", filepath.Join("..", "..", "example", "chart-hooks"),
+		"--image=alpine=registry.example.org/alpine:3.14"}
+	err := Execute(nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.org/alpine:3.14\n", out.String())
+}
+
+func TestParseImageFlag(t *testing.T) {
+	img, err := parseImageFlag("alpine=registry.example.org/alpine:3.14@sha256:abc")
+	require.NoError(t, err)
+	require.Equal(t, "alpine", img.Name)
+	require.Equal(t, "registry.example.org/alpine", img.NewName)
+	require.Equal(t, "3.14", img.NewTag)
+	require.Equal(t, "sha256:abc", img.Digest)
+	img, err = parseImageFlag("alpine=alpine:3.14")
+	require.NoError(t, err)
+	require.Equal(t, "", img.NewName)
+	_, err = parseImageFlag("alpine")
+	require.Error(t, err)
+}
@@ -9,8 +9,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mgoltzsche/khelm/v2/pkg/helm"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
@@ -18,9 +20,15 @@ const (
 	envKustomizePluginConfig     = "KUSTOMIZE_PLUGIN_CONFIG_STRING"
 	envKustomizePluginConfigRoot = "KUSTOMIZE_PLUGIN_CONFIG_ROOT"
 	envTrustAnyRepo              = "KHELM_TRUST_ANY_REPO"
+	envMirrors                   = "KHELM_MIRRORS"
+	envMirrorsFile               = "KHELM_MIRRORS_FILE"
+	envTrustPolicy               = "KHELM_TRUST_POLICY"
+	envIndexTTL                  = "KHELM_INDEX_TTL"
+	envImageDigestTTL            = "KHELM_IMAGE_DIGEST_TTL"
 	envDebug                     = "KHELM_DEBUG"
 	envHelmDebug                 = "HELM_DEBUG"
 	flagTrustAnyRepo             = "trust-any-repo"
+	flagTrustPolicy              = "trust-policy"
 	usageExample                 = "  khelm template ./chart\n  khelm template stable/jenkins\n  khelm template jenkins --version=2.5.3 --repo=https://kubernetes-charts.storage.googleapis.com"
 )
 
@@ -41,6 +49,26 @@ func Execute(reader io.Reader, writer io.Writer) error {
 		trust, _ := strconv.ParseBool(trustAnyRepo)
 		h.TrustAnyRepository = &trust
 	}
+	mirrors, err := loadMirrors()
+	if err != nil {
+		return err
+	}
+	h.Mirrors = mirrors
+	if file := os.Getenv(envTrustPolicy); file != "" {
+		if h.TrustPolicy, err = helm.LoadTrustPolicy(file); err != nil {
+			return err
+		}
+	}
+	if ttl := os.Getenv(envIndexTTL); ttl != "" {
+		if h.IndexMaxAge, err = time.ParseDuration(ttl); err != nil {
+			return errors.Wrap(err, envIndexTTL)
+		}
+	}
+	if ttl := os.Getenv(envImageDigestTTL); ttl != "" {
+		if h.ImageDigestMaxAge, err = time.ParseDuration(ttl); err != nil {
+			return errors.Wrap(err, envImageDigestTTL)
+		}
+	}
 
 	// Run as kustomize plugin (if kustomize-specific env var provided)
 	if kustomizeGenCfgYAML, isKustomizePlugin := os.LookupEnv(envKustomizePluginConfig); isKustomizePlugin {
@@ -82,7 +110,9 @@ In addition to helm's templating capabilities khelm allows to:
  * use any repository without registering it in repositories.yaml
  * enforce namespace-scoped resources within the template output
  * set a namespace on all resources
- * convert a helm chart's output into a kustomization`
+ * convert a helm chart's output into a kustomization
+ * override and list the container images
+ * vendor a chart including its dependencies`
 
 	// Add template command (for non-kpt usage)
 	templateCmd := templateCommand(h, writer)
@@ -91,6 +121,20 @@ In addition to helm's templating capabilities khelm allows to:
 	templateCmd.PreRun = logVersionPreRun
 	rootCmd.AddCommand(templateCmd)
 
+	// Add images command
+	imagesCmd := imagesCommand(h, writer)
+	imagesCmd.SetOut(writer)
+	imagesCmd.SetErr(&errBuf)
+	imagesCmd.PreRun = logVersionPreRun
+	rootCmd.AddCommand(imagesCmd)
+
+	// Add vendor command
+	vendorCmd := vendorCommand(h)
+	vendorCmd.SetOut(writer)
+	vendorCmd.SetErr(&errBuf)
+	vendorCmd.PreRun = logVersionPreRun
+	rootCmd.AddCommand(vendorCmd)
+
 	// Run command
 	if err := rootCmd.Execute(); err != nil {
 		logStackTrace(err, debug)
@@ -103,6 +147,23 @@ In addition to helm's templating capabilities khelm allows to:
 	return nil
 }
 
+// loadMirrors loads the repository mirrors from the file and the list specified by env vars
+func loadMirrors() (helm.Mirrors, error) {
+	var mirrors helm.Mirrors
+	if file := os.Getenv(envMirrorsFile); file != "" {
+		m, err := helm.LoadMirrors(file)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, m...)
+	}
+	m, err := helm.ParseMirrors(os.Getenv(envMirrors))
+	if err != nil {
+		return nil, errors.Wrap(err, envMirrors)
+	}
+	return append(mirrors, m...), nil
+}
+
 func logVersion() {
 	log.Println("Running khelm", versionInfo())
 }
@@ -3,53 +3,75 @@ package main
 import (
 	"fmt"
 	"io"
+	"log"
+	"strings"
 
 	"github.com/mgoltzsche/khelm/v2/internal/output"
 	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/mgoltzsche/khelm/v2/pkg/helm"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"helm.sh/helm/v3/pkg/strvals"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
+const defaultReleaseName = "release-name"
+
 func templateCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
-	req := config.NewChartConfig()
-	defaultReleaseName := "release-name"
-	req.Name = defaultReleaseName
+	chart := &chartFlags{}
+	req := &chart.ChartConfig
 	outOpts := output.Options{Writer: writer}
-	trustAnyRepo := false
+	testsOutput := ""
 	cmd := &cobra.Command{
-		Use: "template",
-		Args: func(cmd *cobra.Command, args []string) error {
-			if len(args) != 1 && len(args) != 2 {
-				_ = cmd.Help()
-				return fmt.Errorf("accepts [NAME] CHART arguments but received %d arguments", len(args))
-			}
-			return nil
-		},
+		Use:        "template",
+		Args:       chartArgs,
 		SuggestFor: []string{"render", "build"},
 		Short:      "Renders a chart",
 		Example:    usageExample,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if cmd.Flags().Changed(flagTrustAnyRepo) {
-				h.TrustAnyRepository = &trustAnyRepo
+			if err := chart.apply(h, cmd, args); err != nil {
+				return err
 			}
 			out, err := output.New(outOpts)
 			if err != nil {
 				return err
 			}
-			if len(args) > 1 {
-				if req.Name != defaultReleaseName {
-					return fmt.Errorf("cannot provide both the --name option and the argument")
+			var testsOut output.Output
+			if testsOutput != "" {
+				if testsOutput == "-" || testsOutput == outOpts.FileOrDir {
+					return fmt.Errorf("--tests-output must specify a file or directory other than --output")
+				}
+				// The directory layout, sync and kustomization options apply to the main output only
+				testsOpts := output.Options{FileOrDir: testsOutput, Format: outOpts.Format, Replace: outOpts.Replace}
+				testsOut, err = output.New(testsOpts)
+				if err != nil {
+					return err
+				}
+				if err = keepTestHooks(req); err != nil {
+					return err
 				}
-				req.Name = args[0]
-				req.Chart = args[1]
-			} else {
-				req.Chart = args[0]
 			}
 			resources, err := render(h, req)
 			if err != nil {
 				return err
 			}
+			if output.IsDirectory(outOpts.FileOrDir) && len(outOpts.Kustomization.Values) > 0 {
+				if outOpts.Values, err = traceValues(h, req, &outOpts.Kustomization); err != nil {
+					return err
+				}
+				if out, err = output.New(outOpts); err != nil {
+					return err
+				}
+			}
+			if testsOut != nil {
+				var tests []*yaml.RNode
+				resources, tests = splitTestHooks(resources)
+				if len(tests) == 0 {
+					log.Printf("WARNING: chart %s does not contain tests", req.Chart)
+				} else if err = testsOut.Write(tests); err != nil {
+					return err
+				}
+			}
 			return out.Write(resources)
 		},
 		SilenceErrors: true,
@@ -60,32 +82,153 @@ func templateCommand(h *helm.Helm, writer io.Writer) *cobra.Command {
 		return err
 	})
 	f := cmd.Flags()
-	f.StringVar(&req.Repository, "repo", "", "Chart repository url where to locate the requested chart")
-	f.StringVar(&req.Repository, "repository", "", "Chart repository url where to locate the requested chart")
-	f.Lookup("repository").Hidden = true
-	f.StringVar(&req.Version, "version", "", "Specify the exact chart version to use. If this is not specified, the latest version is used")
-	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
-		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
-	f.BoolVar(&req.NamespacedOnly, "namespaced-only", false, "Fail on known cluster-scoped resources and those of unknown kinds")
-	f.StringVar(&req.Keyring, "keyring", req.Keyring, "Keyring used to verify the chart")
-	f.BoolVar(&req.Verify, "verify", false, "Verify the package before using it")
-	f.BoolVar(&req.ReplaceLockFile, "replace-lock-file", false, "Remove requirements.lock and reload charts when it is out of sync")
-	f.StringVar(&req.Name, "name", req.Name, "Release name")
-	f.StringVar(&req.Namespace, "namespace", req.Namespace, "Set the installation namespace used by helm templates")
-	f.StringVar(&req.ForceNamespace, "force-namespace", req.ForceNamespace, "Set namespace on all namespaced resources (and those of unknown kinds)")
-	f.Var((*valuesFlag)(&req.Values), "set", "Set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
-	f.StringSliceVarP(&req.ValueFiles, "values", "f", nil, "Specify values in a YAML file or a URL (can specify multiple)")
-	f.StringSliceVar(&req.APIVersions, "api-versions", nil, "Kubernetes api versions used for Capabilities.APIVersions")
-	f.StringVar(&req.KubeVersion, "kube-version", req.KubeVersion, "Kubernetes version used as Capabilities.KubeVersion.Major/Minor")
-	f.BoolVar(&req.ExcludeCRDs, "skip-crds", false, "excludes CRDs from the chart output if enabled")
-	f.BoolVar(&req.ExcludeHooks, "no-hooks", req.ExcludeHooks, "If enabled hooks are omitted from the output")
-	f.BoolVar(&req.ExcludeHooks, "exclude-hooks", req.ExcludeHooks, "If enabled hooks are omitted from the output")
-	f.Lookup("exclude-hooks").Hidden = true
+	chart.addFlags(f)
 	f.StringVarP(&outOpts.FileOrDir, "output", "o", "-", "Write rendered output to given file or directory (as kustomization)")
+	f.StringVar(&testsOutput, "tests-output", "", "Write the chart's test hooks to given file or directory instead of the main output")
+	f.StringVar(&outOpts.Format, "output-format", output.FormatYAML, "Output format: yaml, json (List) or jsonl (one object per line)")
+	f.StringVar(&outOpts.Layout, "output-layout", output.LayoutFlat, "File layout when writing to a directory: flat, by-namespace, by-source (chart templates) or by-kind")
 	f.BoolVar(&outOpts.Replace, "output-replace", false, "Delete and recreate the whole output directory or file")
+	f.BoolVar(&outOpts.Sync, "output-sync", false, "Update the previously generated files within the output directory, preserving other files and kustomization.yaml entries")
+	f.StringVar(&outOpts.Kustomization.Namespace, "kustomization-namespace", "", "Set the namespace field within the generated kustomization.yaml")
+	f.StringToStringVar(&outOpts.Kustomization.CommonLabels, "kustomization-common-label", nil, "Set commonLabels within the generated kustomization.yaml (e.g. key1=val1,key2=val2)")
+	f.StringSliceVar(&outOpts.Kustomization.Components, "kustomization-component", nil, "Add a component to the generated kustomization.yaml")
+	f.BoolVar(&outOpts.Kustomization.PatchesPlaceholder, "kustomization-patches-placeholder", false, "Add an empty patches list to the generated kustomization.yaml")
+	f.StringSliceVar(&outOpts.Kustomization.Values, "kustomization-value", nil, "Make the given chart value (e.g. image.tag) configurable within the generated kustomization.yaml using a ConfigMap generator and replacements")
+	f.StringVar(&outOpts.Kustomization.ValuesConfigMap, "kustomization-values-configmap", "", "Name of the generated values ConfigMap (defaults to <release name>-values)")
+	f.BoolVar(&outOpts.Kustomization.SplitCRDs, "split-crds", false, "Write the CRDs into a separate crds/ kustomization that is referenced by the generated kustomization.yaml")
 	return cmd
 }
 
+// chartFlags holds the chart rendering options shared by the commands that render a chart
+type chartFlags struct {
+	config.ChartConfig
+	trustAnyRepo bool
+	trustPolicy  string
+	images       []string
+}
+
+func chartArgs(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		_ = cmd.Help()
+		return fmt.Errorf("accepts [NAME] CHART arguments but received %d arguments", len(args))
+	}
+	return nil
+}
+
+func (c *chartFlags) addFlags(f *pflag.FlagSet) {
+	c.ChartConfig = *config.NewChartConfig()
+	c.Name = defaultReleaseName
+	f.StringVar(&c.Repository, "repo", "", "Chart repository url where to locate the requested chart")
+	f.StringVar(&c.Repository, "repository", "", "Chart repository url where to locate the requested chart")
+	f.Lookup("repository").Hidden = true
+	f.StringVar(&c.Version, "version", "", "Specify the exact chart version to use. If this is not specified, the latest version is used")
+	f.BoolVar(&c.trustAnyRepo, flagTrustAnyRepo, c.trustAnyRepo,
+		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	f.StringVar(&c.trustPolicy, flagTrustPolicy, "", fmt.Sprintf("Trust policy file that allows or denies repositories and OCI registries (%s)", envTrustPolicy))
+	f.BoolVar(&c.NamespacedOnly, "namespaced-only", false, "Fail on known cluster-scoped resources and those of unknown kinds")
+	f.StringVar(&c.Keyring, "keyring", c.Keyring, "Keyring used to verify the chart")
+	f.BoolVar(&c.Verify, "verify", false, "Verify the package before using it")
+	f.BoolVar(&c.ReplaceLockFile, "replace-lock-file", false, "Remove requirements.lock and reload charts when it is out of sync")
+	f.StringVar(&c.RegistryConfig, "registry-config", "", "Path to the OCI registry config file (defaults to helm's)")
+	f.StringVar(&c.CredentialsFile, "credentials-file", "", "Path to a file in the format of repositories.yaml that provides repository credentials")
+	f.StringVar(&c.Name, "name", c.Name, "Release name")
+	f.StringVar(&c.Namespace, "namespace", c.Namespace, "Set the installation namespace used by helm templates")
+	f.StringVar(&c.ForceNamespace, "force-namespace", c.ForceNamespace, "Set namespace on all namespaced resources (and those of unknown kinds)")
+	f.BoolVar(&c.CreateNamespace, "create-namespace", c.CreateNamespace, "Add the (forced) namespace as Namespace resource to the output")
+	f.StringToStringVar(&c.NamespaceLabels, "namespace-label", nil, "Set labels on the created Namespace (e.g. key1=val1,key2=val2)")
+	f.StringToStringVar(&c.NamespaceAnnotations, "namespace-annotation", nil, "Set annotations on the created Namespace (e.g. key1=val1,key2=val2)")
+	f.StringVar(&c.NamePrefix, "name-prefix", c.NamePrefix, "Prepend the given prefix to all resource names (and references to them)")
+	f.StringVar(&c.NameSuffix, "name-suffix", c.NameSuffix, "Append the given suffix to all resource names (and references to them)")
+	f.StringToStringVar(&c.CommonLabels, "common-label", nil, "Add labels to all resources (e.g. key1=val1,key2=val2)")
+	f.StringToStringVar(&c.CommonAnnotations, "common-annotation", nil, "Add annotations to all resources (e.g. key1=val1,key2=val2)")
+	f.BoolVar(&c.CommonMetadataInPodTemplates, "common-metadata-in-pod-templates", false, "Add the common labels and annotations to pod templates as well")
+	f.BoolVar(&c.CommonLabelsInSelectors, "common-labels-in-selectors", false, "Add the common labels to selectors and pod templates as well (selectors are immutable)")
+	f.StringVar(&c.OutputOrder, "output-order", c.OutputOrder, "Order of the output resources: helm, kind or id (default helm)")
+	f.StringToStringVar(&c.Setters, "setter", nil, "Annotate the fields that contain the given chart value with a kpt setter comment (e.g. image.tag=tag) and add an apply-setters function config")
+	f.StringVar(&c.PreserveSource, "preserve-source", c.PreserveSource, "Preserve the source template path of each resource as annotation or comment")
+	f.StringVar(&c.DuplicatePolicy, "duplicate-policy", c.DuplicatePolicy, "How to handle resources with the same ID: fail, keepFirst, keepLast or merge (default fail)")
+	f.Var((*valuesFlag)(&c.Values), "set", "Set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	f.StringSliceVarP(&c.ValueFiles, "values", "f", nil, "Specify values in a YAML file or a URL (can specify multiple)")
+	f.StringSliceVar(&c.APIVersions, "api-versions", nil, "Kubernetes api versions used for Capabilities.APIVersions")
+	f.StringVar(&c.KubeVersion, "kube-version", c.KubeVersion, "Kubernetes version used as Capabilities.KubeVersion.Major/Minor")
+	f.BoolVar(&c.ExcludeCRDs, "skip-crds", false, "excludes CRDs from the chart output if enabled")
+	f.BoolVar(&c.ExcludeHooks, "no-hooks", c.ExcludeHooks, "If enabled hooks are omitted from the output")
+	f.BoolVar(&c.ExcludeHooks, "exclude-hooks", c.ExcludeHooks, "If enabled hooks are omitted from the output")
+	f.Lookup("exclude-hooks").Hidden = true
+	f.StringToStringVar(&c.Hooks.Policies, "hook-policy", nil, "Set the policy per hook type: keep, exclude or convert (e.g. test=exclude,post-install=convert)")
+	f.StringVar(&c.HookConversion, "hook-conversion", "", "Convert the kept hooks into argocd hooks or kpt depends-on annotations")
+	f.StringVar(&c.Hooks.WeightConversion, "hook-weight-conversion", "", "Translate the weights of converted hooks into argocd sync-wave or kpt depends-on annotations")
+	f.BoolVar(&c.ResolveImageDigests, "resolve-image-digests", false, "Pin the container images to the digests resolved from their registries")
+	f.StringArrayVar(&c.images, "image", nil, "Override an image as name=newName:newTag@digest (can specify multiple)")
+}
+
+// apply applies the positional arguments and the flags that cannot be bound directly
+func (c *chartFlags) apply(h *helm.Helm, cmd *cobra.Command, args []string) error {
+	if cmd.Flags().Changed(flagTrustAnyRepo) {
+		h.TrustAnyRepository = &c.trustAnyRepo
+	}
+	if err := applyTrustPolicy(h, c.trustPolicy); err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		if c.Name != defaultReleaseName {
+			return fmt.Errorf("cannot provide both the --name option and the argument")
+		}
+		c.Name = args[0]
+		c.Chart = args[1]
+	} else {
+		c.Chart = args[0]
+	}
+	for _, image := range c.images {
+		img, err := parseImageFlag(image)
+		if err != nil {
+			return err
+		}
+		c.Images = append(c.Images, img)
+	}
+	return nil
+}
+
+// applyTrustPolicy loads the given trust policy file if specified
+func applyTrustPolicy(h *helm.Helm, file string) (err error) {
+	if file != "" {
+		h.TrustPolicy, err = helm.LoadTrustPolicy(file)
+	}
+	return err
+}
+
+// parseImageFlag parses an image override of the form name=newName:newTag@digest
+func parseImageFlag(s string) (img config.Image, err error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return img, fmt.Errorf("invalid --image value %q, expected name=newName:newTag@digest", s)
+	}
+	img.Name = kv[0]
+	ref := kv[1]
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref, img.Digest = ref[:i], ref[i+1:]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, img.NewTag = ref[:i], ref[i+1:]
+	}
+	if ref != img.Name {
+		img.NewName = ref
+	}
+	return img, nil
+}
+
+func splitTestHooks(resources []*yaml.RNode) (r, tests []*yaml.RNode) {
+	r = make([]*yaml.RNode, 0, len(resources))
+	for _, o := range resources {
+		if meta, err := o.GetMeta(); err == nil && isTestHook(&meta) {
+			tests = append(tests, o)
+		} else {
+			r = append(r, o)
+		}
+	}
+	return r, tests
+}
+
 type valuesFlag map[string]interface{}
 
 func (f *valuesFlag) Set(s string) error {
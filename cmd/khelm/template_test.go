@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -81,7 +83,28 @@ func TestTemplateCommand(t *testing.T) {
 		{
 			"force-namespace",
 			[]string{filepath.Join(exampleDir, "force-namespace"), "--force-namespace=forced-namespace"},
-			5, "namespace: forced-namespace",
+			8, "namespace: forced-namespace",
+		},
+		{
+			"create-namespace",
+			[]string{filepath.Join(exampleDir, "force-namespace"), "--force-namespace=forced-namespace",
+				"--create-namespace", "--namespace-label=example.org/managed=khelm"},
+			9, "kind: Namespace\nmetadata:\n  labels:\n    example.org/managed: khelm\n  name: forced-namespace\n",
+		},
+		{
+			"name-prefix",
+			[]string{filepath.Join(exampleDir, "expand-list"), "--name-prefix=x-", "--name-suffix=-y"},
+			3, "name: x-myserviceaccount2-y\n",
+		},
+		{
+			"common-label",
+			[]string{filepath.Join(exampleDir, "release-name"), "--common-label=team=a", "--common-annotation=owner=b"},
+			1, "  labels:\n    team: a\n  annotations:\n    owner: b\n",
+		},
+		{
+			"preserve-source",
+			[]string{filepath.Join(exampleDir, "expand-list"), "--preserve-source=annotation"},
+			3, "khelm.mgoltzsche.github.com/source: list/templates/list.yaml",
 		},
 		{
 			"chart-hooks",
@@ -105,6 +128,87 @@ func TestTemplateCommand(t *testing.T) {
 	}
 }
 
+func TestTemplateCommandTestsOutput(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-tpl-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testsFile := filepath.Join(dir, "tests.yaml")
+	var out bytes.Buffer
+	os.Args = []string{"testee", "template", filepath.Join("..", "..", "example", "chart-hooks"),
+		"--no-hooks", "--tests-output=" + testsFile}
+	err = Execute(nil, &out)
+	require.NoError(t, err)
+	validateYAML(t, out.Bytes(), 1)
+	require.NotContains(t, out.String(), "helm.sh/hook")
+	b, err := os.ReadFile(testsFile)
+	require.NoError(t, err)
+	validateYAML(t, b, 1)
+	require.Contains(t, string(b), "release-name-test")
+
+	// The main output's directory options must not apply to the tests output
+	outDir := filepath.Join(dir, "out") + string(filepath.Separator)
+	testsFile = filepath.Join(dir, "synced-tests.yaml")
+	os.Args = []string{"testee", "template", filepath.Join("..", "..", "example", "chart-hooks"),
+		"--no-hooks", "--output=" + outDir, "--output-sync", "--kustomization-namespace=mynamespace", "--tests-output=" + testsFile}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err, "sync directory output with tests output file")
+	b, err = os.ReadFile(testsFile)
+	require.NoError(t, err)
+	validateYAML(t, b, 1)
+	require.NotContains(t, string(b), "kind: Kustomization")
+	_, err = os.Stat(filepath.Join(outDir, "kustomization.yaml"))
+	require.NoError(t, err, "main output kustomization")
+
+	os.Args = []string{"testee", "template", filepath.Join("..", "..", "example", "chart-hooks"),
+		"--hook-policy=test=exclude", "--tests-output=" + testsFile}
+	err = Execute(nil, &bytes.Buffer{})
+	require.Error(t, err, "excluded test hooks with tests output")
+	require.Contains(t, err.Error(), "test=exclude")
+}
+
+func TestTemplateCommandOutputFormat(t *testing.T) {
+	chartDir := filepath.Join("..", "..", "example", "namespace")
+	for _, c := range []struct {
+		format   string
+		validate func(t *testing.T, b []byte)
+	}{
+		{
+			"json",
+			func(t *testing.T, b []byte) {
+				var l struct {
+					Kind  string
+					Items []map[string]interface{}
+				}
+				err := json.Unmarshal(b, &l)
+				require.NoError(t, err)
+				require.Equal(t, "List", l.Kind, "kind")
+				require.Equal(t, 3, len(l.Items), "items")
+			},
+		},
+		{
+			"jsonl",
+			func(t *testing.T, b []byte) {
+				lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+				require.Equal(t, 3, len(lines), "lines")
+				for _, line := range lines {
+					var o map[string]interface{}
+					err := json.Unmarshal([]byte(line), &o)
+					require.NoError(t, err, "line %q", line)
+					require.NotEmpty(t, o["kind"], "kind")
+				}
+			},
+		},
+	} {
+		t.Run(c.format, func(t *testing.T) {
+			var out bytes.Buffer
+			os.Args = []string{"testee", "template", chartDir, "--output-format=" + c.format}
+			err := Execute(nil, &out)
+			require.NoError(t, err)
+			c.validate(t, out.Bytes())
+		})
+	}
+}
+
 func TestTemplateCommandError(t *testing.T) {
 	dir, err := os.MkdirTemp("", "khelm-tpl-test-")
 	require.NoError(t, err)
@@ -128,6 +232,14 @@ func TestTemplateCommandError(t *testing.T) {
 			"reject cluster scoped resources",
 			[]string{"cert-manager", "--repo=https://charts.jetstack.io", "--namespaced-only"},
 		},
+		{
+			"reject unsupported output format",
+			[]string{filepath.Join("..", "..", "example", "namespace"), "--output-format=xml"},
+		},
+		{
+			"reject json kustomization output",
+			[]string{filepath.Join("..", "..", "example", "namespace"), "--output-format=json", "--output=" + filepath.Join(dir, "out") + "/"},
+		},
 	} {
 		t.Run(c.name, func(t *testing.T) {
 			os.Args = append([]string{"testee", "template"}, c.args...)
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/mgoltzsche/khelm/v2/pkg/helm"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func vendorCommand(h *helm.Helm) *cobra.Command {
+	req := config.NewChartConfig()
+	trustAnyRepo := false
+	trustPolicy := ""
+	dest := ""
+	configFile := ""
+	cmd := &cobra.Command{
+		Use:   "vendor",
+		Args:  cobra.MaximumNArgs(1),
+		Short: "Writes a chart including its dependencies to a local directory or archive",
+		Long: `Loads a chart including its dependencies and writes it to a local directory or .tgz archive.
+When a generator config file is specified the chart is loaded as configured and the config is updated to refer to the local copy.`,
+		Example: "  khelm vendor cert-manager --repo=https://charts.jetstack.io --version=1.5.3 --output=charts/cert-manager\n  khelm vendor --config=generator.yaml --output=charts/cert-manager.tgz",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed(flagTrustAnyRepo) {
+				h.TrustAnyRepository = &trustAnyRepo
+			}
+			if err := applyTrustPolicy(h, trustPolicy); err != nil {
+				return err
+			}
+			if dest == "" {
+				return fmt.Errorf("no --output specified")
+			}
+			if configFile != "" {
+				if len(args) > 0 {
+					return fmt.Errorf("cannot provide both the --config option and the chart argument")
+				}
+				return vendorGeneratorConfig(h, configFile, dest)
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("no chart specified")
+			}
+			req.Chart = args[0]
+			return vendorChart(h, req, dest)
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		_ = cmd.Help()
+		return err
+	})
+	f := cmd.Flags()
+	f.StringVarP(&dest, "output", "o", "", "Directory or .tgz file to write the chart to")
+	f.StringVar(&configFile, "config", "", "Generator config file to load the chart from and to update to refer to the local copy")
+	f.StringVar(&req.Repository, "repo", "", "Chart repository url where to locate the requested chart")
+	f.StringVar(&req.Version, "version", "", "Specify the exact chart version to use. If this is not specified, the latest version is used")
+	f.BoolVar(&trustAnyRepo, flagTrustAnyRepo, trustAnyRepo,
+		fmt.Sprintf("Allow to use repositories that are not registered within repositories.yaml (default is true when repositories.yaml does not exist; %s)", envTrustAnyRepo))
+	f.StringVar(&trustPolicy, flagTrustPolicy, "", fmt.Sprintf("Trust policy file that allows or denies repositories and OCI registries (%s)", envTrustPolicy))
+	f.StringVar(&req.Keyring, "keyring", req.Keyring, "Keyring used to verify the chart")
+	f.BoolVar(&req.Verify, "verify", false, "Verify the package before using it")
+	f.BoolVar(&req.ReplaceLockFile, "replace-lock-file", false, "Remove requirements.lock and reload charts when it is out of sync")
+	f.StringVar(&req.RegistryConfig, "registry-config", "", "Path to the OCI registry config file (defaults to helm's)")
+	f.StringVar(&req.CredentialsFile, "credentials-file", "", "Path to a file in the format of repositories.yaml that provides repository credentials")
+	return cmd
+}
+
+func vendorChart(h *helm.Helm, req *config.ChartConfig, dest string) error {
+	err := h.Vendor(signalContext(), req, dest)
+	logUntrustedRepositoryHint(err)
+	return err
+}
+
+// vendorGeneratorConfig vendors the chart of the given generator config and updates the config to refer to the local copy.
+// The destination is resolved relative to the working directory.
+func vendorGeneratorConfig(h *helm.Helm, configFile, dest string) error {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, err := config.ReadGeneratorConfig(f)
+	if err != nil {
+		return errors.Wrap(err, configFile)
+	}
+	configDir := filepath.Dir(configFile)
+	cfg.BaseDir = configDir
+	if err = vendorChart(h, &cfg.ChartConfig, dest); err != nil {
+		return err
+	}
+	absConfigDir, err := filepath.Abs(configDir)
+	if err != nil {
+		return err
+	}
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	chartPath, err := filepath.Rel(absConfigDir, absDest)
+	if err != nil {
+		return err
+	}
+	chartPath = filepath.ToSlash(chartPath)
+	if !strings.HasPrefix(chartPath, "../") {
+		chartPath = "./" + chartPath
+	}
+	// A chart archive can still be verified using the provenance file that is vendored along with it
+	_, err = os.Stat(dest + ".prov")
+	verifiable := strings.HasSuffix(dest, ".tgz") && err == nil
+	return errors.Wrapf(setGeneratorChart(configFile, chartPath, verifiable), "update %s", configFile)
+}
+
+// setGeneratorChart makes the generator config refer to the given local chart, preserving the other fields and comments.
+// The verification fields are cleared unless the chart is verifiable.
+func setGeneratorChart(configFile, chartPath string, verifiable bool) error {
+	generator, err := yaml.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	filters := []yaml.Filter{
+		yaml.SetField("chart", yaml.NewStringRNode(chartPath)),
+		yaml.Clear("repository"),
+		yaml.Clear("version"),
+	}
+	if !verifiable {
+		filters = append(filters, yaml.Clear("verify"), yaml.Clear("keyring"))
+	}
+	for _, s := range filters {
+		if err = generator.PipeE(s); err != nil {
+			return err
+		}
+	}
+	return yaml.WriteFile(generator, configFile)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVendorCommand(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-vendor-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	chartDir, err := filepath.Abs(filepath.Join("..", "..", "example", "namespace"))
+	require.NoError(t, err)
+	generatorFile := filepath.Join(dir, "generator.yaml")
+	generator := fmt.Sprintf("apiVersion: khelm.mgoltzsche.github.com/v2\nkind: ChartRenderer\nmetadata:\n  name: myrelease\n# the chart\nchart: %s\nversion: 0.1.0\nverify: false\nkeyring: /tmp/pubring.gpg\nnamespace: myns\n", chartDir)
+	err = os.WriteFile(generatorFile, []byte(generator), 0640)
+	require.NoError(t, err)
+
+	os.Args = []string{"testee", "vendor", "--config=" + generatorFile, "--output=" + filepath.Join(dir, "charts", "namespace")}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(generatorFile)
+	require.NoError(t, err)
+	require.Equal(t, "apiVersion: khelm.mgoltzsche.github.com/v2\nkind: ChartRenderer\nmetadata:\n  name: myrelease\n# the chart\nchart: ./charts/namespace\nnamespace: myns\n", string(b))
+	var out bytes.Buffer
+	os.Args = []string{"testee", "template", filepath.Join(dir, "charts", "namespace")}
+	err = Execute(nil, &out)
+	require.NoError(t, err)
+	validateYAML(t, out.Bytes(), 3)
+
+	// The verification fields are kept when vendoring an archive along with its provenance file
+	archiveDir := filepath.Join(dir, "archive")
+	os.Args = []string{"testee", "vendor", chartDir, "--output=" + filepath.Join(archiveDir, "namespace-0.1.0.tgz")}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(archiveDir, "namespace-0.1.0.tgz.prov"), []byte("fake provenance"), 0640)
+	require.NoError(t, err)
+	generator = strings.Replace(generator, "chart: "+chartDir, "chart: "+filepath.Join(archiveDir, "namespace-0.1.0.tgz"), 1)
+	err = os.WriteFile(generatorFile, []byte(generator), 0640)
+	require.NoError(t, err)
+	os.Args = []string{"testee", "vendor", "--config=" + generatorFile, "--output=" + filepath.Join(dir, "charts", "namespace-0.1.0.tgz")}
+	err = Execute(nil, &bytes.Buffer{})
+	require.NoError(t, err)
+	b, err = os.ReadFile(generatorFile)
+	require.NoError(t, err)
+	require.Equal(t, "apiVersion: khelm.mgoltzsche.github.com/v2\nkind: ChartRenderer\nmetadata:\n  name: myrelease\n# the chart\nchart: ./charts/namespace-0.1.0.tgz\nverify: false\nkeyring: /tmp/pubring.gpg\nnamespace: myns\n", string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "charts", "namespace-0.1.0.tgz.prov"))
+	require.NoError(t, err, "vendored provenance file")
+	require.Equal(t, "fake provenance", string(b))
+
+	os.Args = []string{"testee", "vendor", chartDir}
+	err = Execute(nil, &bytes.Buffer{})
+	require.Error(t, err, "missing output")
+}
@@ -2,6 +2,7 @@ package matcher
 
 import (
 	"fmt"
+	"path"
 	"sort"
 	"strings"
 
@@ -10,7 +11,8 @@ import (
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
-const annotationHelmHook = "helm.sh/hook"
+// AnnotationHelmHook specifies the annotation that declares a resource as chart hook
+const AnnotationHelmHook = "helm.sh/hook"
 
 // ResourceMatchers is a group of matchers
 type ResourceMatchers interface {
@@ -65,7 +67,50 @@ func matchSelector(id *config.ResourceSelector, o *yaml.ResourceMeta) bool {
 	return (id.APIVersion == "" || id.APIVersion == o.APIVersion) &&
 		(id.Kind == "" || id.Kind == o.Kind) &&
 		(id.Namespace == "" || id.Namespace == o.Namespace) &&
-		(id.Name == "" || id.Name == o.Name)
+		(id.Name == "" || id.Name == o.Name) &&
+		(!id.SelectsSource() || matchSourceSelector(id, o.Annotations[config.AnnotationSource]))
+}
+
+func matchSourceSelector(id *config.ResourceSelector, source string) bool {
+	if source == "" {
+		return false
+	}
+	charts, template := parseSource(source)
+	return (id.Source == "" || matchSource(id.Source, source)) &&
+		(id.Template == "" || matchSource(id.Template, template)) &&
+		(id.Subchart == "" || containsSubchart(charts, id.Subchart))
+}
+
+// parseSource splits a source template path into the names of the charts it is nested within and
+// the path relative to the chart that contains the template.
+// E.g. mychart/charts/postgresql/templates/x.yaml is split into [mychart postgresql] and templates/x.yaml.
+func parseSource(source string) (charts []string, template string) {
+	segments := strings.Split(source, "/")
+	charts = append(charts, segments[0])
+	i := 1
+	for ; i+1 < len(segments) && segments[i] == "charts"; i += 2 {
+		charts = append(charts, segments[i+1])
+	}
+	return charts, strings.Join(segments[i:], "/")
+}
+
+func containsSubchart(charts []string, subchart string) bool {
+	for _, name := range charts[1:] {
+		if name == subchart {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSource returns true if the given source template path matches the glob pattern.
+// A pattern that ends with / matches all templates within the directory.
+func matchSource(pattern, source string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(source, pattern)
+	}
+	matched, _ := path.Match(pattern, source)
+	return matched
 }
 
 // FromResourceSelectors creates matchers from the provided selectors
@@ -80,15 +125,15 @@ func FromResourceSelectors(selectors []config.ResourceSelector) ResourceMatchers
 // ChartHookMatcher matches chart hook resources when the delegated matcher doesn't match
 type ChartHookMatcher struct {
 	ResourceMatchers
-	delegateOnly bool
-	hooks        map[string]struct{}
+	excludeHook func(hook string) bool
+	hooks       map[string]struct{}
 }
 
-// NewChartHookMatcher creates
-func NewChartHookMatcher(delegate ResourceMatchers, delegateOnly bool) *ChartHookMatcher {
+// NewChartHookMatcher creates a matcher that matches hooks of the types for which excludeHook returns true
+func NewChartHookMatcher(delegate ResourceMatchers, excludeHook func(hook string) bool) *ChartHookMatcher {
 	return &ChartHookMatcher{
 		ResourceMatchers: delegate,
-		delegateOnly:     delegateOnly,
+		excludeHook:      excludeHook,
 		hooks:            map[string]struct{}{},
 	}
 }
@@ -104,19 +149,32 @@ func (m *ChartHookMatcher) FoundHooks() []string {
 }
 
 // Match returns true if any matches matches the given object
+// or if the object is a hook of types that should all be excluded.
 func (m *ChartHookMatcher) Match(o *yaml.ResourceMeta) bool {
 	if m.ResourceMatchers.Match(o) {
 		return true
 	}
 
-	isHook := false
+	hooks := HookTypes(o)
+	exclude := len(hooks) > 0
+	for _, hook := range hooks {
+		m.hooks[hook] = struct{}{}
+		if !m.excludeHook(hook) {
+			exclude = false
+		}
+	}
+	return exclude
+}
+
+// HookTypes returns the chart hook types specified within the given object's annotations
+func HookTypes(o *yaml.ResourceMeta) []string {
+	var hooks []string
 	if a := o.Annotations; a != nil {
-		for _, hook := range strings.Split(a[annotationHelmHook], ",") {
+		for _, hook := range strings.Split(a[AnnotationHelmHook], ",") {
 			if hook = strings.TrimSpace(hook); hook != "" {
-				m.hooks[hook] = struct{}{}
-				isHook = true
+				hooks = append(hooks, hook)
 			}
 		}
 	}
-	return isHook && !m.delegateOnly
+	return hooks
 }
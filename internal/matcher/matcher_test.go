@@ -74,6 +74,60 @@ func TestRequireAllMatched(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMatchSource(t *testing.T) {
+	input := []*yaml.ResourceMeta{
+		testResource("v1", "ConfigMap", "a", ""),
+		testResource("v1", "ConfigMap", "b", ""),
+		testResource("v1", "ConfigMap", "c", ""),
+		testResource("v1", "ConfigMap", "d", ""),
+	}
+	input[0].Annotations = map[string]string{config.AnnotationSource: "mychart/templates/a.yaml"}
+	input[1].Annotations = map[string]string{config.AnnotationSource: "mychart/templates/b.yaml"}
+	input[2].Annotations = map[string]string{config.AnnotationSource: "mychart/charts/sub/templates/c.yaml"}
+	for _, c := range []struct {
+		selector config.ResourceSelector
+		matched  []string
+	}{
+		{config.ResourceSelector{Source: "mychart/templates/a.yaml"}, []string{"a"}},
+		{config.ResourceSelector{Source: "mychart/templates/*.yaml"}, []string{"a", "b"}},
+		{config.ResourceSelector{Source: "mychart/charts/sub/"}, []string{"c"}},
+		{config.ResourceSelector{Source: "mychart/"}, []string{"a", "b", "c"}},
+		{config.ResourceSelector{Source: "other/templates/a.yaml"}, []string{}},
+		{config.ResourceSelector{Template: "templates/a.yaml"}, []string{"a"}},
+		{config.ResourceSelector{Template: "templates/c.yaml"}, []string{"c"}},
+		{config.ResourceSelector{Template: "templates/"}, []string{"a", "b", "c"}},
+		{config.ResourceSelector{Subchart: "sub"}, []string{"c"}},
+		{config.ResourceSelector{Subchart: "mychart"}, []string{}},
+		{config.ResourceSelector{Subchart: "sub", Template: "templates/a.yaml"}, []string{}},
+		{config.ResourceSelector{Subchart: "sub", Template: "templates/*.yaml"}, []string{"c"}},
+	} {
+		testee := FromResourceSelectors([]config.ResourceSelector{c.selector})
+		matched := []string{}
+		for _, o := range input {
+			if testee.Match(o) {
+				matched = append(matched, o.Name)
+			}
+		}
+		require.Equal(t, c.matched, matched, "selector %#v", c.selector)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	for _, c := range []struct {
+		source   string
+		charts   []string
+		template string
+	}{
+		{"mychart/templates/a.yaml", []string{"mychart"}, "templates/a.yaml"},
+		{"mychart/charts/sub/templates/b.yaml", []string{"mychart", "sub"}, "templates/b.yaml"},
+		{"mychart/charts/sub/charts/subsub/templates/c/d.yaml", []string{"mychart", "sub", "subsub"}, "templates/c/d.yaml"},
+	} {
+		charts, template := parseSource(c.source)
+		require.Equal(t, c.charts, charts, "charts of %s", c.source)
+		require.Equal(t, c.template, template, "template of %s", c.source)
+	}
+}
+
 func testResource(apiVersion, kind, name, namespace string) *yaml.ResourceMeta {
 	return &yaml.ResourceMeta{
 		TypeMeta: yaml.TypeMeta{
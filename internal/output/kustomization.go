@@ -0,0 +1,152 @@
+package output
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// CRDsDir is the name of the kustomization directory the CRDs are written to when splitting them
+	CRDsDir           = "crds"
+	kustomizationFile = "kustomization.yaml"
+	kindCRD           = "CustomResourceDefinition"
+)
+
+// NewKustomization creates a kustomization that refers to the given resource paths.
+// When value usages are provided they are made configurable using a ConfigMap generator and replacements.
+func NewKustomization(resources []string, cfg config.KustomizationConfig, values []resource.ValueUsage) (*yaml.RNode, error) {
+	k := yaml.NewRNode(&yaml.Node{Kind: yaml.MappingNode})
+	err := updateKustomization(k, resources, cfg, values)
+	return k, err
+}
+
+// updateKustomization sets the resources and configured fields on the given kustomization.
+// Other fields are preserved.
+func updateKustomization(k *yaml.RNode, resources []string, cfg config.KustomizationConfig, values []resource.ValueUsage) error {
+	setters := []yaml.FieldSetter{
+		yaml.SetField(yaml.APIVersionField, yaml.NewStringRNode(kustomizeAPIVersion)),
+		yaml.SetField(yaml.KindField, yaml.NewStringRNode(kustomizeKind)),
+	}
+	if cfg.Namespace != "" {
+		setters = append(setters, yaml.SetField("namespace", yaml.NewStringRNode(cfg.Namespace)))
+	}
+	if len(cfg.CommonLabels) > 0 {
+		setters = append(setters, yaml.SetField("commonLabels", newStringMapRNode(cfg.CommonLabels)))
+	}
+	setters = append(setters, yaml.SetField("resources", yaml.NewListRNode(resources...)))
+	if len(cfg.Components) > 0 {
+		setters = append(setters, yaml.SetField("components", yaml.NewListRNode(cfg.Components...)))
+	}
+	if cfg.PatchesPlaceholder && k.Field("patches") == nil {
+		setters = append(setters, yaml.SetField("patches", yaml.NewListRNode()))
+	}
+	for _, s := range setters {
+		if err := k.PipeE(s); err != nil {
+			return errors.Wrapf(err, "set kustomization field %s", s.Name)
+		}
+	}
+	if len(values) > 0 {
+		return errors.Wrap(setValueReplacements(k, cfg.ValuesConfigMap, values), "generate value replacements")
+	}
+	return nil
+}
+
+func newStringMapRNode(m map[string]string) *yaml.RNode {
+	n := yaml.NewRNode(&yaml.Node{Kind: yaml.MappingNode})
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		n.YNode().Content = append(n.YNode().Content, yaml.NewStringRNode(k).YNode(), yaml.NewStringRNode(m[k]).YNode())
+	}
+	return n
+}
+
+// SplitCRDs separates the CustomResourceDefinitions from the other resources.
+func SplitCRDs(resources []*yaml.RNode) (crds, other []*yaml.RNode) {
+	other = make([]*yaml.RNode, 0, len(resources))
+	for _, r := range resources {
+		if IsCRD(r) {
+			crds = append(crds, r)
+		} else {
+			other = append(other, r)
+		}
+	}
+	return crds, other
+}
+
+// IsCRD returns true if the given resource is a CustomResourceDefinition.
+func IsCRD(r *yaml.RNode) bool {
+	return r.GetKind() == kindCRD && strings.HasPrefix(r.GetApiVersion(), "apiextensions.k8s.io/")
+}
+
+// kustomizationFiles maps the resources to relative file paths and adds the kustomization files for the CRDs directory if enabled.
+// The returned resource paths are meant to be listed within the main kustomization.
+func kustomizationFiles(resources []*yaml.RNode, layout string, cfg config.KustomizationConfig) (resourcePaths, paths []string, files map[string][]*yaml.RNode, err error) {
+	var crds []*yaml.RNode
+	if cfg.SplitCRDs {
+		crds, resources = SplitCRDs(resources)
+	}
+	paths, files, err = resourceFiles(resources, layout)
+	if err != nil || len(crds) == 0 {
+		return paths, paths, files, err
+	}
+	crdPaths, crdFiles, err := resourceFiles(crds, layout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	crdKustomization, err := NewKustomization(crdPaths, config.KustomizationConfig{}, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	crdPaths = append(crdPaths, kustomizationFile)
+	crdFiles[kustomizationFile] = []*yaml.RNode{crdKustomization}
+	resourcePaths = append([]string{CRDsDir}, paths...)
+	for _, p := range crdPaths {
+		crdPath := path.Join(CRDsDir, p)
+		if _, exists := files[crdPath]; exists {
+			return nil, nil, nil, errors.Errorf("output file path collision: %s is used by a resource and the CRDs", crdPath)
+		}
+		paths = append(paths, crdPath)
+		files[crdPath] = crdFiles[p]
+	}
+	return resourcePaths, paths, files, nil
+}
+
+// mergeKustomizationResources returns the generated paths followed by the kustomization's resources that have not been generated by khelm.
+func mergeKustomizationResources(kustomization *yaml.RNode, paths, previous []string) ([]string, error) {
+	resources, err := kustomization.Pipe(yaml.Lookup("resources"))
+	if err != nil || resources == nil {
+		return paths, err
+	}
+	elements, err := resources.Elements()
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]bool{}
+	for _, p := range previous {
+		generated[p] = true
+		if path.Base(p) == kustomizationFile {
+			// generated nested kustomization directory
+			generated[path.Dir(p)] = true
+		}
+	}
+	for _, p := range paths {
+		generated[p] = true
+	}
+	merged := append([]string{}, paths...)
+	for _, e := range elements {
+		if r := e.YNode().Value; !generated[r] {
+			merged = append(merged, r)
+		}
+	}
+	return merged, nil
+}
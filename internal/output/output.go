@@ -2,13 +2,17 @@ package output
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/pkg/errors"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
@@ -18,11 +22,38 @@ const (
 	kustomizeKind       = "Kustomization"
 )
 
+const (
+	// FormatYAML writes the resources as multi-document YAML
+	FormatYAML = "yaml"
+	// FormatJSON writes the resources as JSON List
+	FormatJSON = "json"
+	// FormatJSONLines writes one JSON object per line
+	FormatJSONLines = "jsonl"
+)
+
+const (
+	// LayoutFlat writes each resource to <kind>_<name>.yaml
+	LayoutFlat = "flat"
+	// LayoutByNamespace writes each resource to <namespace>/<kind>_<name>.yaml
+	LayoutByNamespace = "by-namespace"
+	// LayoutBySource writes the resources to the chart template paths they originate from
+	LayoutBySource = "by-source"
+	// LayoutByKind writes each resource to <kind>/<name>.yaml
+	LayoutByKind = "by-kind"
+)
+
 // Options specifies the output options
 type Options struct {
 	FileOrDir string
 	Replace   bool
+	Sync      bool
 	Writer    io.Writer
+	Format    string
+	Layout    string
+	// Kustomization specifies additional fields of the generated kustomization
+	Kustomization config.KustomizationConfig
+	// Values specifies the chart values that should be made configurable within the generated kustomization
+	Values []resource.ValueUsage
 }
 
 // Output specifies a kubernetes resource sink
@@ -44,115 +75,219 @@ func ResourcePath(meta yaml.ResourceMeta, basePath string) string {
 
 // New creates a new output from the given options
 func New(o Options) (Output, error) {
+	switch o.Format {
+	case "":
+		o.Format = FormatYAML
+	case FormatYAML, FormatJSON, FormatJSONLines:
+	default:
+		return nil, errors.Errorf("unsupported output format %q, expected one of %s, %s, %s", o.Format, FormatYAML, FormatJSON, FormatJSONLines)
+	}
+	switch o.Layout {
+	case "":
+		o.Layout = LayoutFlat
+	case LayoutFlat, LayoutByNamespace, LayoutBySource, LayoutByKind:
+	default:
+		return nil, errors.Errorf("unsupported output layout %q, expected one of %s, %s, %s, %s", o.Layout, LayoutFlat, LayoutByNamespace, LayoutBySource, LayoutByKind)
+	}
+	if o.Replace && o.Sync {
+		return nil, errors.New("output replacement and sync cannot be enabled both")
+	}
 	if o.FileOrDir == "" && o.Writer == nil {
 		return nil, errors.New("neither output file nor writer specified")
 	} else if o.FileOrDir == "" || o.FileOrDir == "-" {
 		if o.Replace {
 			return nil, errors.New("output replacement cannot be enabled when writing to writer")
 		}
-		return &writerOutput{o.Writer}, nil
+		if o.Sync {
+			return nil, errors.New("output sync cannot be enabled when writing to writer")
+		}
+		return &writerOutput{o.Writer, o.Format}, nil
 	} else if IsDirectory(o.FileOrDir) {
-		return &kustomizationOutput{dirOutput{o.FileOrDir, o.Replace}}, nil
+		if o.Format != FormatYAML {
+			return nil, errors.Errorf("output format %s is not supported when writing a kustomization directory", o.Format)
+		}
+		return &kustomizationOutput{dirOutput{o.FileOrDir, o.Replace, o.Sync, o.Layout}, o.Kustomization, o.Values}, nil
+	}
+	if o.Sync {
+		return nil, errors.Errorf("output sync requires a directory output (ending with /) but %q provided", o.FileOrDir)
 	}
-	return &fileOutput{o.FileOrDir, o.Replace}, nil
+	return &fileOutput{o.FileOrDir, o.Replace, o.Format}, nil
 }
 
 type fileOutput struct {
 	file    string
 	replace bool
+	format  string
 }
 
 func (w *fileOutput) Write(resources []*yaml.RNode) (err error) {
-	return writeToFile(resources, w.file, w.replace)
+	return writeToFile(resources, w.file, w.replace, w.format)
 }
 
 type dirOutput struct {
 	dir     string
 	replace bool
+	sync    bool
+	layout  string
 }
 
 func (w *dirOutput) Write(resources []*yaml.RNode) error {
+	paths, files, err := resourceFiles(resources, w.layout)
+	if err != nil {
+		return err
+	}
+	_, err = w.write(paths, files)
+	return err
+}
+
+// write writes the files into the directory and returns the previously generated file paths relative to it.
+func (w *dirOutput) write(paths []string, files map[string][]*yaml.RNode) (previous []string, err error) {
+	if w.sync {
+		return syncFiles(w.dir, paths, files)
+	}
 	if w.replace {
 		if err := os.RemoveAll(w.dir); err != nil {
-			return errors.New(err.Error())
+			return nil, errors.New(err.Error())
 		}
 	}
 	if err := os.MkdirAll(w.dir, 0750); err != nil {
-		return errors.New(err.Error())
+		return nil, errors.New(err.Error())
 	}
 	if !w.replace {
 		containsFiles, err := containsFiles(w.dir)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if containsFiles {
-			return errors.Errorf("output directory %q already contains files. use --out-replace to delete and recreate the directory", w.dir)
+			return nil, errors.Errorf("output directory %q already contains files. use --output-replace to delete and recreate the directory or --output-sync to update it", w.dir)
 		}
 	}
-	for _, r := range resources {
-		resource := []*yaml.RNode{r}
-		var buf bytes.Buffer
-		_ = Marshal(resource, &buf)
-		raw := strings.ReplaceAll(buf.String(), "\n", "\n  ")
-		m, err := r.GetMeta()
-		if err != nil {
-			return errors.Errorf("invalid output resource metadata: %s\n  provided resource:\n  %s", err.Error(), raw)
-		}
-		if m.Name == "" {
-			return errors.Errorf("output resource has no name:\n  %s", raw)
-		}
-		outFile := filepath.FromSlash(ResourcePath(m, filepath.ToSlash(w.dir)))
-		if err = writeToFile(resource, outFile, false); err != nil {
-			return err
+	for _, p := range paths {
+		outFile := filepath.Join(w.dir, filepath.FromSlash(p))
+		if err = writeToFile(files[p], outFile, false, FormatYAML); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 type kustomizationOutput struct {
 	dirOutput
+	kustomization config.KustomizationConfig
+	values        []resource.ValueUsage
 }
 
-func (w kustomizationOutput) Write(resources []*yaml.RNode) (err error) {
-	if err = w.dirOutput.Write(resources); err != nil {
+func (w kustomizationOutput) Write(resources []*yaml.RNode) error {
+	resourcePaths, paths, files, err := kustomizationFiles(resources, w.layout, w.kustomization)
+	if err != nil {
 		return err
 	}
-	paths := make([]string, len(resources))
-	for i, r := range resources {
-		m, _ := r.GetMeta()
-		paths[i] = ResourcePath(m, "")
-	}
-	kustomization := map[string]interface{}{}
-	kustomization["apiVersion"] = kustomizeAPIVersion
-	kustomization["kind"] = kustomizeKind
-	kustomization["resources"] = paths
-	kustomizationFile := filepath.Join(w.dir, "kustomization.yaml")
-	f, err := os.OpenFile(kustomizationFile, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
-	defer func() {
-		if e := f.Close(); e != nil && err == nil {
-			err = errors.Errorf("close file writer: %s", e)
+	previous, err := w.dirOutput.write(paths, files)
+	if err != nil {
+		return err
+	}
+	kustomizationFile := filepath.Join(w.dir, kustomizationFile)
+	kustomization := yaml.NewRNode(&yaml.Node{Kind: yaml.MappingNode})
+	if w.sync {
+		if _, err = os.Stat(kustomizationFile); err == nil {
+			if kustomization, err = yaml.ReadFile(kustomizationFile); err != nil {
+				return errors.Wrap(err, "read kustomization")
+			}
+			resourcePaths, err = mergeKustomizationResources(kustomization, resourcePaths, previous)
+			if err != nil {
+				return errors.Wrapf(err, "merge %s", kustomizationFile)
+			}
 		}
-	}()
-	b, err := yaml.Marshal(kustomization)
+	}
+	values := FilterValueUsages(w.values, resources)
+	if err = updateKustomization(kustomization, resourcePaths, w.kustomization, values); err != nil {
+		return err
+	}
+	s, err := kustomization.String()
 	if err != nil {
 		return errors.Wrap(err, "marshal kustomization.yaml")
 	}
-	_, err = f.Write(b)
-	if err != nil {
-		return errors.Wrap(err, "write kustomization.yaml")
+	err = writeFileIfChanged(kustomizationFile, []byte(s))
+	return errors.Wrap(err, "write kustomization.yaml")
+}
+
+// outputFile holds the resources that are written into the same file
+type outputFile struct {
+	resources []*yaml.RNode
+	ids       []string
+	shared    bool
+}
+
+// resourceFiles maps the resources to relative file paths according to the given layout.
+// Resources are only written into the same file when they originate from the same chart template (by-source layout).
+// Other resources that map to the same path are reported as collision.
+func resourceFiles(resources []*yaml.RNode, layout string) ([]string, map[string][]*yaml.RNode, error) {
+	paths := make([]string, 0, len(resources))
+	files := make(map[string]*outputFile, len(resources))
+	collisions := []string{}
+	for _, r := range resources {
+		var buf bytes.Buffer
+		_ = Marshal([]*yaml.RNode{r}, &buf)
+		raw := strings.ReplaceAll(buf.String(), "\n", "\n  ")
+		m, err := r.GetMeta()
+		if err != nil {
+			return nil, nil, errors.Errorf("invalid output resource metadata: %s\n  provided resource:\n  %s", err.Error(), raw)
+		}
+		if m.Name == "" {
+			return nil, nil, errors.Errorf("output resource has no name:\n  %s", raw)
+		}
+		p, shared := layoutPath(r, m, layout)
+		f := files[p]
+		if f == nil {
+			f = &outputFile{shared: shared}
+			files[p] = f
+			paths = append(paths, p)
+		} else if (!shared || !f.shared) && len(f.ids) > 0 && !slices.Contains(collisions, p) {
+			collisions = append(collisions, p)
+		}
+		f.resources = append(f.resources, r)
+		f.ids = append(f.ids, resource.ID(m))
 	}
-	return nil
+	if len(collisions) > 0 {
+		msgs := make([]string, len(collisions))
+		for i, p := range collisions {
+			msgs[i] = fmt.Sprintf("%s: %s", p, strings.Join(files[p].ids, ", "))
+		}
+		return nil, nil, errors.Errorf("output file path collision, multiple resources map to the same file (choose another output layout):\n * %s", strings.Join(msgs, "\n * "))
+	}
+	m := make(map[string][]*yaml.RNode, len(files))
+	for p, f := range files {
+		m[p] = f.resources
+	}
+	return paths, m, nil
+}
+
+// layoutPath returns the relative output file path of a resource and whether the file can be shared with other resources.
+func layoutPath(r *yaml.RNode, m yaml.ResourceMeta, layout string) (string, bool) {
+	switch layout {
+	case LayoutByNamespace:
+		return ResourcePath(m, m.Namespace), false
+	case LayoutByKind:
+		return path.Join(strings.ToLower(m.Kind), fmt.Sprintf("%s.yaml", m.Name)), false
+	case LayoutBySource:
+		source := path.Clean(resource.SourceTemplate(r))
+		if source != "." && !path.IsAbs(source) && source != ".." && !strings.HasPrefix(source, "../") {
+			return source, true
+		}
+	}
+	return ResourcePath(m, ""), false
 }
 
 type writerOutput struct {
-	out io.Writer
+	out    io.Writer
+	format string
 }
 
 func (w *writerOutput) Write(resources []*yaml.RNode) error {
-	return Marshal(resources, w.out)
+	return marshal(resources, w.out, w.format)
 }
 
-func writeToFile(resources []*yaml.RNode, outFile string, replace bool) error {
+func writeToFile(resources []*yaml.RNode, outFile string, replace bool, format string) error {
 	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
 	if replace {
 		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
@@ -174,7 +309,51 @@ func writeToFile(resources []*yaml.RNode, outFile string, replace bool) error {
 		}
 	}()
 
-	return errors.Wrapf(Marshal(resources, f), "write output file %s", outFile)
+	return errors.Wrapf(marshal(resources, f, format), "write output file %s", outFile)
+}
+
+func marshal(resources []*yaml.RNode, writer io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return MarshalJSON(resources, writer)
+	case FormatJSONLines:
+		return MarshalJSONLines(resources, writer)
+	}
+	return Marshal(resources, writer)
+}
+
+// MarshalJSON writes the given list of resources as JSON List into the given writer
+func MarshalJSON(resources []*yaml.RNode, writer io.Writer) error {
+	items := make([]json.RawMessage, len(resources))
+	for i, r := range resources {
+		b, err := r.MarshalJSON()
+		if err != nil {
+			return errors.Errorf("marshal resource %d: %s", i, err)
+		}
+		items[i] = b
+	}
+	enc := json.NewEncoder(writer)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	})
+	return errors.Wrap(err, "marshal list")
+}
+
+// MarshalJSONLines writes the given list of resources as one JSON object per line into the given writer
+func MarshalJSONLines(resources []*yaml.RNode, writer io.Writer) error {
+	for i, r := range resources {
+		b, err := r.MarshalJSON()
+		if err != nil {
+			return errors.Errorf("marshal resource %d: %s", i, err)
+		}
+		if _, err = writer.Write(append(b, '\n')); err != nil {
+			return errors.Wrapf(err, "write resource %d", i)
+		}
+	}
+	return nil
 }
 
 // Marshal writes the given list of resources as YAML into the given writer
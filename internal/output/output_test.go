@@ -0,0 +1,294 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const layoutManifest = `---
+# Source: mychart/templates/config.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  namespace: ns1
+---
+# Source: mychart/templates/config.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  namespace: ns2
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: ns1
+`
+
+func TestDirOutputLayout(t *testing.T) {
+	for _, c := range []struct {
+		layout   string
+		expected []string
+	}{
+		{LayoutByNamespace, []string{"ns1/configmap_myconfig.yaml", "ns2/configmap_myconfig.yaml", "namespace_ns1.yaml"}},
+		{LayoutBySource, []string{"mychart/templates/config.yaml", "namespace_ns1.yaml"}},
+		{LayoutByKind, nil},
+		{LayoutFlat, nil},
+	} {
+		t.Run(c.layout, func(t *testing.T) {
+			resources, err := kio.FromBytes([]byte(layoutManifest))
+			require.NoError(t, err)
+			dir, err := os.MkdirTemp("", "khelm-output-test-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			testee, err := New(Options{FileOrDir: dir + "/", Layout: c.layout})
+			require.NoError(t, err)
+			err = testee.Write(resources)
+			if c.expected == nil {
+				require.Error(t, err, "should report collision")
+				require.Contains(t, err.Error(), "v1/ConfigMap/ns1/myconfig, v1/ConfigMap/ns2/myconfig")
+				return
+			}
+			require.NoError(t, err)
+			b, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+			require.NoError(t, err)
+			var kustomization struct {
+				Resources []string
+			}
+			err = yaml.Unmarshal(b, &kustomization)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, kustomization.Resources, "kustomization resources")
+			for _, f := range c.expected {
+				_, err = os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+				require.NoError(t, err, "written file")
+			}
+			if c.layout == LayoutBySource {
+				b, err = os.ReadFile(filepath.Join(dir, "mychart", "templates", "config.yaml"))
+				require.NoError(t, err)
+				require.Equal(t, 2, strings.Count(string(b), "kind: ConfigMap"), "resources within source file")
+			}
+		})
+	}
+}
+
+func TestNewInvalidLayout(t *testing.T) {
+	_, err := New(Options{FileOrDir: "out/", Layout: "unknown"})
+	require.Error(t, err)
+}
+
+func TestDirOutputSync(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-output-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	resources, err := kio.FromBytes([]byte(layoutManifest))
+	require.NoError(t, err)
+	testee, err := New(Options{FileOrDir: dir + "/", Layout: LayoutByNamespace, Sync: true})
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.NoError(t, err)
+	kustomizationFile := filepath.Join(dir, "kustomization.yaml")
+	b, err := os.ReadFile(kustomizationFile)
+	require.NoError(t, err)
+	customFile := filepath.Join(dir, "custom-patch.yaml")
+	err = os.WriteFile(customFile, []byte("custom"), 0640)
+	require.NoError(t, err)
+	err = os.WriteFile(kustomizationFile, []byte(strings.Replace(string(b), "resources:\n", "resources:\n- custom.yaml\n", 1)+"patches:\n- path: custom-patch.yaml\n"), 0640)
+	require.NoError(t, err)
+
+	_, err = New(Options{FileOrDir: dir + "/", Sync: true, Replace: true})
+	require.Error(t, err, "sync and replace")
+	testee, err = New(Options{FileOrDir: dir + "/", Sync: true})
+	require.NoError(t, err)
+	err = testee.Write(resources[:1])
+	require.NoError(t, err)
+
+	b, err = os.ReadFile(kustomizationFile)
+	require.NoError(t, err)
+	require.Equal(t, "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n- configmap_myconfig.yaml\n- custom.yaml\npatches:\n- path: custom-patch.yaml\n", string(b))
+	for _, f := range []string{"configmap_myconfig.yaml", "custom-patch.yaml"} {
+		_, err = os.Stat(filepath.Join(dir, f))
+		require.NoError(t, err, "file %s should exist", f)
+	}
+	for _, f := range []string{"ns1", "ns2", "namespace_ns1.yaml"} {
+		_, err = os.Stat(filepath.Join(dir, f))
+		require.True(t, os.IsNotExist(err), "file %s should have been removed", f)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "namespace_ns1.yaml"), []byte("custom"), 0640)
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.Error(t, err, "should not overwrite file that has not been generated")
+}
+
+func TestDirOutputSyncWithoutManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-output-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	resources, err := kio.FromBytes([]byte(layoutManifest))
+	require.NoError(t, err)
+	testee, err := New(Options{FileOrDir: dir + "/", Layout: LayoutByNamespace})
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, manifestFile))
+	require.True(t, os.IsNotExist(err), "non-sync output should not write %s", manifestFile)
+
+	// Switch from plain to sync output: files with unchanged content are adopted
+	testee, err = New(Options{FileOrDir: dir + "/", Layout: LayoutByNamespace, Sync: true})
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.NoError(t, err, "sync output directory written without sync")
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "ns1/configmap_myconfig.yaml", manifestFile)
+	b, err = os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(b), "- ns1/configmap_myconfig.yaml"), "kustomization resources")
+	err = testee.Write(resources[:2])
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "namespace_ns1.yaml"))
+	require.True(t, os.IsNotExist(err), "adopted file should be removed when not generated anymore")
+
+	err = os.WriteFile(filepath.Join(dir, "namespace_ns1.yaml"), []byte("custom"), 0640)
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.Error(t, err, "should not overwrite changed files that are not listed within %s", manifestFile)
+}
+
+func TestKustomizationOutputConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-output-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	resources, err := kio.FromBytes([]byte(layoutManifest + `---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: examples.example.org
+`))
+	require.NoError(t, err)
+	testee, err := New(Options{FileOrDir: dir + "/", Layout: LayoutByNamespace, Kustomization: config.KustomizationConfig{
+		Namespace:          "myns",
+		CommonLabels:       map[string]string{"b": "2", "a": "1"},
+		Components:         []string{"../component"},
+		PatchesPlaceholder: true,
+		SplitCRDs:          true,
+	}})
+	require.NoError(t, err)
+	err = testee.Write(resources)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: myns
+commonLabels:
+  a: "1"
+  b: "2"
+resources:
+- crds
+- ns1/configmap_myconfig.yaml
+- ns2/configmap_myconfig.yaml
+- namespace_ns1.yaml
+components:
+- ../component
+patches: []
+`, string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "crds", "kustomization.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n- customresourcedefinition_examples.example.org.yaml\n", string(b))
+	_, err = os.Stat(filepath.Join(dir, "crds", "customresourcedefinition_examples.example.org.yaml"))
+	require.NoError(t, err)
+}
+
+func TestNewKustomizationValues(t *testing.T) {
+	values := []resource.ValueUsage{
+		{Path: "image.tag", Value: "1.2", Targets: []resource.ValueTarget{
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Namespace: "ns", FieldPath: "spec.template.spec.containers.[name=app].image", Delimiter: ":", Index: 1},
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Namespace: "ns", FieldPath: "spec.template.spec.initContainers.[name=init].image", Delimiter: ":", Index: 1},
+		}},
+		{Path: "replicas", Value: "2", Targets: []resource.ValueTarget{
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Namespace: "ns", FieldPath: "spec.replicas"},
+		}},
+	}
+	k, err := yaml.Parse(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+configMapGenerator:
+- name: other
+- name: myvalues
+  literals:
+  - outdated=value
+replacements:
+- source:
+    kind: ConfigMap
+    name: myvalues
+    fieldPath: data.outdated
+- source:
+    kind: Secret
+    name: other
+`)
+	require.NoError(t, err)
+	err = updateKustomization(k, []string{"deployment.yaml"}, config.KustomizationConfig{ValuesConfigMap: "myvalues"}, values)
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+configMapGenerator:
+- name: other
+- name: myvalues
+  literals:
+  - image_tag=1.2
+  - replicas=2
+  options:
+    disableNameSuffixHash: true
+    annotations:
+      config.kubernetes.io/local-config: "true"
+replacements:
+- source:
+    kind: Secret
+    name: other
+- source:
+    kind: ConfigMap
+    name: myvalues
+    fieldPath: data.image_tag
+  targets:
+  - select:
+      group: apps
+      version: v1
+      kind: Deployment
+      name: app
+      namespace: ns
+    fieldPaths:
+    - spec.template.spec.containers.[name=app].image
+    - spec.template.spec.initContainers.[name=init].image
+    options:
+      delimiter: ':'
+      index: 1
+- source:
+    kind: ConfigMap
+    name: myvalues
+    fieldPath: data.replicas
+  targets:
+  - select:
+      group: apps
+      version: v1
+      kind: Deployment
+      name: app
+      namespace: ns
+    fieldPaths:
+    - spec.replicas
+resources:
+- deployment.yaml
+`, k.MustString())
+
+	resources, err := kio.FromBytes([]byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: other\n  namespace: ns\n"))
+	require.NoError(t, err)
+	require.Empty(t, FilterValueUsages(values, resources), "filtered values")
+}
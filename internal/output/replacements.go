@@ -0,0 +1,200 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+type configMapGenerator struct {
+	Name     string           `yaml:"name"`
+	Literals []string         `yaml:"literals"`
+	Options  generatorOptions `yaml:"options"`
+}
+
+type generatorOptions struct {
+	DisableNameSuffixHash bool              `yaml:"disableNameSuffixHash"`
+	Annotations           map[string]string `yaml:"annotations"`
+}
+
+type replacement struct {
+	Source  replacementSource   `yaml:"source"`
+	Targets []replacementTarget `yaml:"targets"`
+}
+
+type replacementSource struct {
+	Kind      string `yaml:"kind"`
+	Name      string `yaml:"name"`
+	FieldPath string `yaml:"fieldPath"`
+}
+
+type replacementTarget struct {
+	Select     targetSelector `yaml:"select"`
+	FieldPaths []string       `yaml:"fieldPaths"`
+	Options    *targetOptions `yaml:"options,omitempty"`
+}
+
+type targetSelector struct {
+	Group     string `yaml:"group,omitempty"`
+	Version   string `yaml:"version,omitempty"`
+	Kind      string `yaml:"kind"`
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type targetOptions struct {
+	Delimiter string `yaml:"delimiter"`
+	Index     int    `yaml:"index,omitempty"`
+}
+
+// FilterValueUsages returns the value usages with only the targets that are contained within the given resources.
+// Values that are not used within the resources are omitted.
+func FilterValueUsages(values []resource.ValueUsage, resources []*yaml.RNode) []resource.ValueUsage {
+	ids := map[string]bool{}
+	for _, r := range resources {
+		if m, err := r.GetMeta(); err == nil {
+			ids[resource.ID(m)] = true
+		}
+	}
+	filtered := make([]resource.ValueUsage, 0, len(values))
+	for _, v := range values {
+		targets := make([]resource.ValueTarget, 0, len(v.Targets))
+		for _, t := range v.Targets {
+			m := yaml.ResourceMeta{TypeMeta: yaml.TypeMeta{APIVersion: t.APIVersion, Kind: t.Kind}}
+			m.Name = t.Name
+			m.Namespace = t.Namespace
+			if ids[resource.ID(m)] {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) > 0 {
+			v.Targets = targets
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+// setValueReplacements adds a local ConfigMap generator that holds the values
+// as well as replacements that copy the values into the fields they were rendered to.
+// Previously generated entries are replaced, others are preserved.
+func setValueReplacements(k *yaml.RNode, configMapName string, values []resource.ValueUsage) error {
+	if configMapName == "" {
+		return errors.New("no values ConfigMap name specified")
+	}
+	generator := configMapGenerator{
+		Name: configMapName,
+		Options: generatorOptions{
+			DisableNameSuffixHash: true,
+			Annotations:           map[string]string{filters.LocalConfigAnnotation: "true"},
+		},
+	}
+	replacements := make([]replacement, 0, len(values))
+	keys := map[string]string{}
+	for _, v := range values {
+		key := valueKey(v.Path)
+		if p, exists := keys[key]; exists {
+			return errors.Errorf("values %s and %s map to the same ConfigMap key %s", p, v.Path, key)
+		}
+		keys[key] = v.Path
+		generator.Literals = append(generator.Literals, fmt.Sprintf("%s=%s", key, v.Value))
+		replacements = append(replacements, replacement{
+			Source:  replacementSource{Kind: "ConfigMap", Name: configMapName, FieldPath: "data." + key},
+			Targets: replacementTargets(v.Targets),
+		})
+	}
+	err := setListItems(k, "configMapGenerator", []interface{}{generator}, func(item *yaml.RNode) bool {
+		return stringField(item, yaml.NameField) == configMapName
+	})
+	if err != nil {
+		return err
+	}
+	items := make([]interface{}, len(replacements))
+	for i, r := range replacements {
+		items[i] = r
+	}
+	return setListItems(k, "replacements", items, func(item *yaml.RNode) bool {
+		source := item.Field("source")
+		return source != nil && stringField(source.Value, yaml.KindField) == "ConfigMap" && stringField(source.Value, yaml.NameField) == configMapName
+	})
+}
+
+// replacementTargets groups the fields of a value by resource and delimiter.
+func replacementTargets(targets []resource.ValueTarget) []replacementTarget {
+	result := make([]replacementTarget, 0, len(targets))
+	index := map[resource.ValueTarget]int{}
+	for _, t := range targets {
+		fieldPath := t.FieldPath
+		t.FieldPath = ""
+		if i, ok := index[t]; ok {
+			result[i].FieldPaths = append(result[i].FieldPaths, fieldPath)
+			continue
+		}
+		group, version := "", t.APIVersion
+		if i := strings.Index(version, "/"); i >= 0 {
+			group, version = version[:i], version[i+1:]
+		}
+		r := replacementTarget{
+			Select: targetSelector{
+				Group:     group,
+				Version:   version,
+				Kind:      t.Kind,
+				Name:      t.Name,
+				Namespace: t.Namespace,
+			},
+			FieldPaths: []string{fieldPath},
+		}
+		if t.Delimiter != "" {
+			r.Options = &targetOptions{Delimiter: t.Delimiter, Index: t.Index}
+		}
+		index[t] = len(result)
+		result = append(result, r)
+	}
+	return result
+}
+
+// setListItems sets the given items within the list field of the kustomization, replacing the items that match the given function.
+func setListItems(k *yaml.RNode, field string, items []interface{}, replace func(*yaml.RNode) bool) error {
+	list := yaml.NewListRNode()
+	if existing, err := k.Pipe(yaml.Lookup(field)); err != nil {
+		return err
+	} else if existing != nil {
+		elements, err := existing.Elements()
+		if err != nil {
+			return errors.Wrapf(err, "kustomization field %s", field)
+		}
+		for _, e := range elements {
+			if !replace(e) {
+				list.YNode().Content = append(list.YNode().Content, e.YNode())
+			}
+		}
+	}
+	for _, item := range items {
+		b, err := yaml.Marshal(item)
+		if err != nil {
+			return err
+		}
+		n, err := yaml.Parse(string(b))
+		if err != nil {
+			return err
+		}
+		list.YNode().Content = append(list.YNode().Content, n.YNode())
+	}
+	return k.PipeE(yaml.SetField(field, list))
+}
+
+// valueKey maps a value path to a ConfigMap key that can be addressed within a kustomize field path.
+func valueKey(path string) string {
+	return strings.ReplaceAll(path, ".", "_")
+}
+
+func stringField(n *yaml.RNode, name string) string {
+	if f := n.Field(name); f != nil && f.Value.YNode().Kind == yaml.ScalarNode {
+		return f.Value.YNode().Value
+	}
+	return ""
+}
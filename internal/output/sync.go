@@ -0,0 +1,112 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// manifestFile is the name of the file within the output directory that lists the generated files
+const manifestFile = ".khelm-output"
+
+// syncFiles writes the changed files into the directory, deletes previously generated files that are not generated anymore
+// and returns the previously generated file paths.
+// Files that have not been generated by khelm are preserved unless their content equals the generated content.
+func syncFiles(dir string, paths []string, files map[string][]*yaml.RNode) ([]string, error) {
+	previous, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]bool{}
+	for _, p := range previous {
+		generated[p] = true
+	}
+	for _, p := range paths {
+		outFile := filepath.Join(dir, filepath.FromSlash(p))
+		var buf bytes.Buffer
+		if err = Marshal(files[p], &buf); err != nil {
+			return nil, errors.Wrapf(err, "marshal %s", outFile)
+		}
+		if !generated[p] {
+			// Adopt existing files that equal the generated ones (e.g. written by a previous non-sync run)
+			if b, err := os.ReadFile(outFile); err == nil && !bytes.Equal(b, buf.Bytes()) {
+				return nil, errors.Errorf("output sync: refusing to overwrite file %s since it has not been generated by khelm", outFile)
+			}
+		}
+		if err = writeFileIfChanged(outFile, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		delete(generated, p)
+	}
+	for _, p := range previous {
+		if !generated[p] {
+			continue
+		}
+		outFile := filepath.Join(dir, filepath.FromSlash(p))
+		if err = os.Remove(outFile); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "output sync: remove stale file")
+		}
+		removeEmptyParentDirs(dir, filepath.Dir(outFile))
+	}
+	return previous, writeManifest(dir, paths)
+}
+
+// readManifest returns the relative file paths that have been generated into the directory previously.
+func readManifest(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read output manifest")
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		// Ignore paths that point outside the output directory
+		if p = path.Clean(p); path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			continue
+		}
+		paths = append(paths, p)
+	}
+	return paths, errors.Wrap(scanner.Err(), "read output manifest")
+}
+
+// writeManifest writes the list of generated files into the directory.
+func writeManifest(dir string, paths []string) error {
+	content := "# Files generated by khelm. Do not edit.\n" + strings.Join(paths, "\n") + "\n"
+	err := writeFileIfChanged(filepath.Join(dir, manifestFile), []byte(content))
+	return errors.Wrap(err, "write output manifest")
+}
+
+// writeFileIfChanged writes the file unless it already exists with the same content.
+func writeFileIfChanged(file string, content []byte) error {
+	if b, err := os.ReadFile(file); err == nil && bytes.Equal(b, content) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return errors.Wrap(err, "write output file")
+	}
+	return errors.Wrap(os.WriteFile(file, content, 0640), "write output file")
+}
+
+// removeEmptyParentDirs removes the given directory and its parents up to the root directory as long as they are empty.
+func removeEmptyParentDirs(root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package resource provides the types and helpers describing rendered chart resources
+// that are shared between the renderer and the output writers.
+package resource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// SourceCommentPrefix prefixes the template path within the source comment helm writes into a resource's header.
+const SourceCommentPrefix = "# Source: "
+
+// ValueUsage describes where a chart value ends up within the rendered resources.
+type ValueUsage struct {
+	Path    string
+	Value   string
+	Targets []ValueTarget
+}
+
+// ValueTarget specifies a resource field that contains a chart value.
+// When Delimiter is set the value is the field value's Index-th element separated by Delimiter.
+type ValueTarget struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+	FieldPath  string
+	Delimiter  string
+	Index      int
+}
+
+// ID returns a string that identifies the resource with the given metadata.
+func ID(m yaml.ResourceMeta) string {
+	return fmt.Sprintf("%s/%s/%s/%s", m.APIVersion, m.Kind, m.Namespace, m.Name)
+}
+
+// SourceTemplate returns the path of the chart template the given resource originates from.
+// The path is read from the source annotation or from the source comment helm writes into the resource's header.
+func SourceTemplate(o *yaml.RNode) string {
+	if source := o.GetAnnotations()[config.AnnotationSource]; source != "" {
+		return source
+	}
+	n := o.YNode()
+	comments := n.HeadComment
+	if n.Kind == yaml.MappingNode && len(n.Content) > 0 {
+		comments = fmt.Sprintf("%s\n%s", comments, n.Content[0].HeadComment)
+	}
+	for _, line := range strings.Split(comments, "\n") {
+		if strings.HasPrefix(line, SourceCommentPrefix) {
+			return strings.TrimSpace(line[len(SourceCommentPrefix):])
+		}
+	}
+	return ""
+}
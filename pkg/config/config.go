@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -18,8 +20,72 @@ const (
 	GeneratorAPIVersion = "khelm.mgoltzsche.github.com/v2"
 	// GeneratorKind specifies the API kind field value supported by the generator
 	GeneratorKind = "ChartRenderer"
+	// AnnotationSource specifies the annotation that holds the path of the chart template a resource originates from
+	AnnotationSource = "khelm.mgoltzsche.github.com/source"
 )
 
+const (
+	// DuplicatePolicyFail makes rendering fail when the chart output contains duplicate resources
+	DuplicatePolicyFail = "fail"
+	// DuplicatePolicyKeepFirst keeps the first of duplicate resources
+	DuplicatePolicyKeepFirst = "keepFirst"
+	// DuplicatePolicyKeepLast keeps the last of duplicate resources
+	DuplicatePolicyKeepLast = "keepLast"
+	// DuplicatePolicyMerge merges duplicate resources into the first one
+	DuplicatePolicyMerge = "merge"
+)
+
+const (
+	// PreserveSourceAnnotation specifies that a resource's source template path is written into an annotation
+	PreserveSourceAnnotation = "annotation"
+	// PreserveSourceComment specifies that a resource's source template path is written into a comment
+	PreserveSourceComment = "comment"
+)
+
+const (
+	// HookPolicyKeep keeps a chart hook as is
+	HookPolicyKeep = "keep"
+	// HookPolicyExclude excludes a chart hook from the output
+	HookPolicyExclude = "exclude"
+	// HookPolicyConvert converts a chart hook into a plain resource by removing its helm.sh/hook* annotations
+	HookPolicyConvert = "convert"
+	// HookConversionArgoCD converts chart hook properties into Argo CD annotations
+	HookConversionArgoCD = "argocd"
+	// HookConversionKpt converts chart hook properties into kpt annotations
+	HookConversionKpt = "kpt"
+)
+
+const (
+	// OutputOrderHelm preserves the order in which helm renders the resources
+	OutputOrderHelm = "helm"
+	// OutputOrderKind sorts the resources by kind in installation order and by ID within the same kind
+	OutputOrderKind = "kind"
+	// OutputOrderID sorts the resources alphabetically by apiVersion, kind, namespace and name
+	OutputOrderID = "id"
+)
+
+// HookTypes lists the chart hook types supported by Helm
+var HookTypes = []string{
+	"pre-install", "post-install",
+	"pre-delete", "post-delete",
+	"pre-upgrade", "post-upgrade",
+	"pre-rollback", "post-rollback",
+	"test", "test-success",
+}
+
+// TestHookTypes lists the chart hook types that run chart tests
+var TestHookTypes = []string{"test", "test-success"}
+
+// IsTestHook returns true if the given hook types contain a test hook type
+func IsTestHook(hookTypes []string) bool {
+	for _, hook := range hookTypes {
+		if slices.Contains(TestHookTypes, hook) {
+			return true
+		}
+	}
+	return false
+}
+
 // KRMFuncConfig defines the KRM function input.
 type KRMFuncConfigFile struct {
 	APIVersion    string      `yaml:"apiVersion"`
@@ -36,9 +102,22 @@ type KRMFuncConfig struct {
 	ChartConfig       `yaml:",inline"`
 	OutputPath        string                 `yaml:"outputPath,omitempty"`
 	OutputPathMapping []KRMFuncOutputMapping `yaml:"outputPathMapping,omitempty"`
+	TestsOutputPath   string                 `yaml:"testsOutputPath,omitempty"`
+	Kustomization     KustomizationConfig    `yaml:"kustomization,omitempty"`
 	Debug             bool                   `yaml:"debug,omitempty"`
 }
 
+// KustomizationConfig specifies additional fields of the kustomizations that are generated for directory outputs.
+type KustomizationConfig struct {
+	Namespace          string            `yaml:"namespace,omitempty"`
+	CommonLabels       map[string]string `yaml:"commonLabels,omitempty"`
+	Components         []string          `yaml:"components,omitempty"`
+	PatchesPlaceholder bool              `yaml:"patchesPlaceholder,omitempty"`
+	SplitCRDs          bool              `yaml:"splitCRDs,omitempty"`
+	Values             []string          `yaml:"values,omitempty"`
+	ValuesConfigMap    string            `yaml:"valuesConfigMap,omitempty"`
+}
+
 // KRMFuncOutputMapping maps resources that match the selector to the specified output path.
 type KRMFuncOutputMapping struct {
 	Selectors  []ResourceSelector `yaml:"selectors,omitempty"`
@@ -96,22 +175,66 @@ type LoaderConfig struct {
 	Verify          bool   `yaml:"verify,omitempty"`
 	Keyring         string `yaml:"keyring,omitempty"`
 	ReplaceLockFile bool   `yaml:"replaceLockFile,omitempty"`
+	RegistryConfig  string `yaml:"registryConfig,omitempty"`
+	CredentialsFile string `yaml:"credentialsFile,omitempty"`
 }
 
 // RendererConfig defines the configuration to render a chart
 type RendererConfig struct {
-	Name           string                 `yaml:"name,omitempty"`
-	Namespace      string                 `yaml:"namespace,omitempty"`
-	ValueFiles     []string               `yaml:"valueFiles,omitempty"`
-	Values         map[string]interface{} `yaml:"values,omitempty"`
-	KubeVersion    string                 `yaml:"kubeVersion,omitempty"`
-	APIVersions    []string               `yaml:"apiVersions,omitempty"`
-	ExcludeCRDs    bool                   `yaml:"excludeCRDs,omitempty"` // TODO: test this option
-	Include        []ResourceSelector     `yaml:"include,omitempty"`
-	Exclude        []ResourceSelector     `yaml:"exclude,omitempty"`
-	ExcludeHooks   bool                   `yaml:"excludeHooks,omitempty"`
-	NamespacedOnly bool                   `yaml:"namespacedOnly,omitempty"`
-	ForceNamespace string                 `yaml:"forceNamespace,omitempty"`
+	Name                         string                 `yaml:"name,omitempty"`
+	Namespace                    string                 `yaml:"namespace,omitempty"`
+	ValueFiles                   []string               `yaml:"valueFiles,omitempty"`
+	Values                       map[string]interface{} `yaml:"values,omitempty"`
+	KubeVersion                  string                 `yaml:"kubeVersion,omitempty"`
+	APIVersions                  []string               `yaml:"apiVersions,omitempty"`
+	ExcludeCRDs                  bool                   `yaml:"excludeCRDs,omitempty"` // TODO: test this option
+	Include                      []ResourceSelector     `yaml:"include,omitempty"`
+	Exclude                      []ResourceSelector     `yaml:"exclude,omitempty"`
+	ExcludeHooks                 bool                   `yaml:"excludeHooks,omitempty"`
+	NamespacedOnly               bool                   `yaml:"namespacedOnly,omitempty"`
+	ForceNamespace               string                 `yaml:"forceNamespace,omitempty"`
+	CreateNamespace              bool                   `yaml:"createNamespace,omitempty"`
+	NamespaceLabels              map[string]string      `yaml:"namespaceLabels,omitempty"`
+	NamespaceAnnotations         map[string]string      `yaml:"namespaceAnnotations,omitempty"`
+	NamespaceReferences          []FieldSpec            `yaml:"namespaceReferences,omitempty"`
+	NamePrefix                   string                 `yaml:"namePrefix,omitempty"`
+	NameSuffix                   string                 `yaml:"nameSuffix,omitempty"`
+	CommonLabels                 map[string]string      `yaml:"commonLabels,omitempty"`
+	CommonAnnotations            map[string]string      `yaml:"commonAnnotations,omitempty"`
+	CommonMetadataInPodTemplates bool                   `yaml:"commonMetadataInPodTemplates,omitempty"`
+	CommonLabelsInSelectors      bool                   `yaml:"commonLabelsInSelectors,omitempty"`
+	Images                       []Image                `yaml:"images,omitempty"`
+	ResolveImageDigests          bool                   `yaml:"resolveImageDigests,omitempty"`
+	OutputOrder                  string                 `yaml:"outputOrder,omitempty"`
+	Setters                      map[string]string      `yaml:"setters,omitempty"`
+	DuplicatePolicy              string                 `yaml:"duplicatePolicy,omitempty"`
+	PreserveSource               string                 `yaml:"preserveSource,omitempty"`
+	Hooks                        HookConfig             `yaml:"hooks,omitempty"`
+	HookConversion               string                 `yaml:"hookConversion,omitempty"`
+}
+
+// HookConfig specifies how chart hooks are handled
+type HookConfig struct {
+	Policies         map[string]string `yaml:"policies,omitempty"`
+	WeightConversion string            `yaml:"weightConversion,omitempty"`
+}
+
+// FieldSpec refers to a field within resources of a given kind, similar to kustomize's fieldSpecs.
+// The path separates fields with "/" and traverses sequences implicitly.
+type FieldSpec struct {
+	Group   string `yaml:"group,omitempty"`
+	Version string `yaml:"version,omitempty"`
+	Kind    string `yaml:"kind,omitempty"`
+	Path    string `yaml:"path"`
+}
+
+// Image specifies a container image override, similar to kustomize's images field.
+// A digest takes precedence over a tag.
+type Image struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName,omitempty"`
+	NewTag  string `yaml:"newTag,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
 }
 
 // ResourceSelector specifies a Kubernetes resource selector
@@ -120,6 +243,14 @@ type ResourceSelector struct {
 	Kind       string `yaml:"kind,omitempty"`
 	Namespace  string `yaml:"namespace,omitempty"`
 	Name       string `yaml:"name,omitempty"`
+	Source     string `yaml:"source,omitempty"`
+	Subchart   string `yaml:"subchart,omitempty"`
+	Template   string `yaml:"template,omitempty"`
+}
+
+// SelectsSource returns true if the selector matches resources by their source template
+func (s *ResourceSelector) SelectsSource() bool {
+	return s.Source != "" || s.Subchart != "" || s.Template != ""
 }
 
 // Validate validates the chart renderer config
@@ -133,9 +264,86 @@ func (cfg *ChartConfig) Validate() (errs []string) {
 	if cfg.Namespace == "" {
 		errs = append(errs, "release namespace not specified")
 	}
+	if !cfg.CreateNamespace && (len(cfg.NamespaceLabels) > 0 || len(cfg.NamespaceAnnotations) > 0) {
+		errs = append(errs, "namespaceLabels and namespaceAnnotations require createNamespace to be enabled")
+	}
+	for i, f := range cfg.NamespaceReferences {
+		if strings.Trim(f.Path, "/") == "" {
+			errs = append(errs, fmt.Sprintf("no path specified for namespaceReferences[%d]", i))
+		}
+	}
+	for i, img := range cfg.Images {
+		if img.Name == "" {
+			errs = append(errs, fmt.Sprintf("no name specified for images[%d]", i))
+		}
+	}
+	switch cfg.DuplicatePolicy {
+	case "", DuplicatePolicyFail, DuplicatePolicyKeepFirst, DuplicatePolicyKeepLast, DuplicatePolicyMerge:
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported duplicatePolicy %q, expected one of %s, %s, %s, %s",
+			cfg.DuplicatePolicy, DuplicatePolicyFail, DuplicatePolicyKeepFirst, DuplicatePolicyKeepLast, DuplicatePolicyMerge))
+	}
+	switch cfg.PreserveSource {
+	case "", PreserveSourceAnnotation, PreserveSourceComment:
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported preserveSource %q, expected one of %s, %s",
+			cfg.PreserveSource, PreserveSourceAnnotation, PreserveSourceComment))
+	}
+	switch cfg.OutputOrder {
+	case "", OutputOrderHelm, OutputOrderKind, OutputOrderID:
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported outputOrder %q, expected one of %s, %s, %s",
+			cfg.OutputOrder, OutputOrderHelm, OutputOrderKind, OutputOrderID))
+	}
+	errs = append(errs, cfg.Hooks.validate()...)
+	switch cfg.HookConversion {
+	case "", HookConversionArgoCD, HookConversionKpt:
+		if cfg.HookConversion != "" && cfg.Hooks.WeightConversion != "" && cfg.HookConversion != cfg.Hooks.WeightConversion {
+			errs = append(errs, fmt.Sprintf("hookConversion %q and hooks.weightConversion %q must not differ", cfg.HookConversion, cfg.Hooks.WeightConversion))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported hookConversion %q, expected one of %s, %s",
+			cfg.HookConversion, HookConversionArgoCD, HookConversionKpt))
+	}
+	setterPaths := map[string]string{}
+	for path, name := range cfg.Setters {
+		if name == "" {
+			errs = append(errs, fmt.Sprintf("no setter name specified for value %s", path))
+		} else if p, exists := setterPaths[name]; exists {
+			errs = append(errs, fmt.Sprintf("setter %s is specified for multiple values: %s", name, strings.Join(sortedStrings(p, path), ", ")))
+		}
+		setterPaths[name] = path
+	}
 	return
 }
 
+func sortedStrings(s ...string) []string {
+	sort.Strings(s)
+	return s
+}
+
+func (cfg *HookConfig) validate() (errs []string) {
+	for hook, policy := range cfg.Policies {
+		if !slices.Contains(HookTypes, hook) {
+			errs = append(errs, fmt.Sprintf("unsupported hook type %q specified within hooks.policies, expected one of %s", hook, strings.Join(HookTypes, ", ")))
+		}
+		switch policy {
+		case HookPolicyKeep, HookPolicyExclude, HookPolicyConvert:
+		default:
+			errs = append(errs, fmt.Sprintf("unsupported hook policy %q specified for hook type %q, expected one of %s, %s, %s",
+				policy, hook, HookPolicyKeep, HookPolicyExclude, HookPolicyConvert))
+		}
+	}
+	sort.Strings(errs)
+	switch cfg.WeightConversion {
+	case "", HookConversionArgoCD, HookConversionKpt:
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported hooks.weightConversion %q, expected one of %s, %s",
+			cfg.WeightConversion, HookConversionArgoCD, HookConversionKpt))
+	}
+	return errs
+}
+
 // ReadGeneratorConfig read the generator configuration
 func ReadGeneratorConfig(reader io.Reader) (cfg *GeneratorConfig, err error) {
 	cfg = &GeneratorConfig{}
@@ -34,3 +34,49 @@ func TestReadGeneratorConfigUnsupportedFieldError(t *testing.T) {
 	_, err = ReadGeneratorConfig(f)
 	require.Error(t, err)
 }
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		cfg   RendererConfig
+		valid bool
+	}{
+		{"defaults", RendererConfig{}, true},
+		{"duplicatePolicy", RendererConfig{DuplicatePolicy: DuplicatePolicyMerge}, true},
+		{"invalid duplicatePolicy", RendererConfig{DuplicatePolicy: "unknown"}, false},
+		{"preserveSource", RendererConfig{PreserveSource: PreserveSourceAnnotation}, true},
+		{"invalid preserveSource", RendererConfig{PreserveSource: "unknown"}, false},
+		{"hook policy", RendererConfig{Hooks: HookConfig{Policies: map[string]string{"test": HookPolicyExclude}}}, true},
+		{"invalid hook policy", RendererConfig{Hooks: HookConfig{Policies: map[string]string{"test": "unknown"}}}, false},
+		{"invalid hook type", RendererConfig{Hooks: HookConfig{Policies: map[string]string{"unknown": HookPolicyKeep}}}, false},
+		{"create namespace", RendererConfig{CreateNamespace: true, NamespaceLabels: map[string]string{"a": "b"}}, true},
+		{"namespace labels without createNamespace", RendererConfig{NamespaceLabels: map[string]string{"a": "b"}}, false},
+		{"namespace references", RendererConfig{NamespaceReferences: []FieldSpec{{Kind: "MyKind", Path: "spec/service/namespace"}}}, true},
+		{"namespace reference without path", RendererConfig{NamespaceReferences: []FieldSpec{{Kind: "MyKind"}}}, false},
+		{"output order", RendererConfig{OutputOrder: OutputOrderKind}, true},
+		{"invalid output order", RendererConfig{OutputOrder: "unknown"}, false},
+		{"hook weight conversion", RendererConfig{Hooks: HookConfig{WeightConversion: HookConversionKpt}}, true},
+		{"invalid hook weight conversion", RendererConfig{Hooks: HookConfig{WeightConversion: "unknown"}}, false},
+		{"hook conversion", RendererConfig{HookConversion: HookConversionArgoCD}, true},
+		{"hook conversion with weight conversion", RendererConfig{HookConversion: HookConversionArgoCD, Hooks: HookConfig{WeightConversion: HookConversionArgoCD}}, true},
+		{"hook conversion with different weight conversion", RendererConfig{HookConversion: HookConversionArgoCD, Hooks: HookConfig{WeightConversion: HookConversionKpt}}, false},
+		{"invalid hook conversion", RendererConfig{HookConversion: "unknown"}, false},
+		{"setters", RendererConfig{Setters: map[string]string{"image.tag": "tag", "image.repository": "image"}}, true},
+		{"setter without name", RendererConfig{Setters: map[string]string{"image.tag": ""}}, false},
+		{"duplicate setter", RendererConfig{Setters: map[string]string{"image.tag": "tag", "other": "tag"}}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := NewChartConfig()
+			cfg.Chart = "mychart"
+			cfg.RendererConfig = c.cfg
+			cfg.Name = "myrelease"
+			cfg.ApplyDefaults()
+			errs := cfg.Validate()
+			if c.valid {
+				require.Empty(t, errs)
+			} else {
+				require.Len(t, errs, 1, "validation errors")
+			}
+		})
+	}
+}
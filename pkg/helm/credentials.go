@@ -0,0 +1,172 @@
+package helm
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/credentials"
+)
+
+const envRepoCredentialsPrefix = "KHELM_REPO_"
+
+// repositoryCredentials provides the credentials of repositories that don't specify any within repositories.yaml.
+// Credentials are looked up within the credentials file (in the format of repositories.yaml) by URL first
+// and within the env vars KHELM_REPO_<HOST>_USERNAME and KHELM_REPO_<HOST>_PASSWORD afterwards.
+type repositoryCredentials struct {
+	entries map[string]*repo.Entry
+}
+
+func loadRepositoryCredentials(credentialsFile string) (*repositoryCredentials, error) {
+	c := &repositoryCredentials{entries: map[string]*repo.Entry{}}
+	if credentialsFile == "" {
+		return c, nil
+	}
+	f, err := repo.LoadFile(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load repository credentials")
+	}
+	for _, e := range f.Repositories {
+		c.entries[strings.TrimSuffix(e.URL, "/")] = e
+	}
+	return c, nil
+}
+
+// apply sets the credentials on the given repository entry unless it specifies credentials already.
+// It returns true if credentials have been set.
+func (c *repositoryCredentials) apply(entry *repo.Entry) bool {
+	if entry.Username != "" || entry.Password != "" || entry.CertFile != "" {
+		return false
+	}
+	if e := c.entries[strings.TrimSuffix(entry.URL, "/")]; e != nil {
+		entry.Username = e.Username
+		entry.Password = e.Password
+		entry.CertFile = e.CertFile
+		entry.KeyFile = e.KeyFile
+		if e.CAFile != "" {
+			entry.CAFile = e.CAFile
+		}
+		entry.InsecureSkipTLSverify = entry.InsecureSkipTLSverify || e.InsecureSkipTLSverify
+		entry.PassCredentialsAll = entry.PassCredentialsAll || e.PassCredentialsAll
+		return true
+	}
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return false
+	}
+	username, password, ok := envCredentials(u.Host)
+	if ok {
+		entry.Username = username
+		entry.Password = password
+	}
+	return ok
+}
+
+// registryCredential returns the credentials for the given OCI registry host if any are configured.
+func (c *repositoryCredentials) registryCredential(host string) (auth.Credential, bool) {
+	if e := c.entries[registry.OCIScheme+"://"+host]; e != nil {
+		return auth.Credential{Username: e.Username, Password: e.Password}, true
+	}
+	username, password, ok := envCredentials(host)
+	return auth.Credential{Username: username, Password: password}, ok
+}
+
+// envCredentials returns the credentials specified for the given host using the env vars
+// KHELM_REPO_<HOST>_USERNAME and KHELM_REPO_<HOST>_PASSWORD.
+// Within the host name all characters except letters and digits are replaced with '_'.
+func envCredentials(host string) (username, password string, ok bool) {
+	if host == "" {
+		return "", "", false
+	}
+	prefix := envRepoCredentialsPrefix + hostEnvName(host)
+	username = os.Getenv(prefix + "_USERNAME")
+	password = os.Getenv(prefix + "_PASSWORD")
+	return username, password, username != "" || password != ""
+}
+
+func hostEnvName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// newRegistryClient creates an OCI registry client that authenticates using newRegistryAuthorizer.
+func newRegistryClient(cfg *config.LoaderConfig, settings *cli.EnvSettings, mirrors Mirrors) (*registry.Client, error) {
+	authorizer, err := newRegistryAuthorizer(cfg, settings, mirrors)
+	if err != nil {
+		return nil, err
+	}
+	client, err := registry.NewClient(
+		registry.ClientOptEnableCache(true),
+		registry.ClientOptCredentialsFile(registryConfigFile(cfg, settings)),
+		registry.ClientOptAuthorizer(*authorizer),
+	)
+	return client, errors.WithStack(err)
+}
+
+// newRegistryAuthorizer creates an OCI registry auth client that authenticates using the configured credentials
+// or, if none are configured for a registry, using the credentials from the registry config file
+// with fallback to docker's config (as helm does).
+// Requests to mirrored registries are sent to the mirrors using the mirrors' credentials.
+func newRegistryAuthorizer(cfg *config.LoaderConfig, settings *cli.EnvSettings, mirrors Mirrors) (*auth.Client, error) {
+	creds, err := loadRepositoryCredentials(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newCredentialsStore(registryConfigFile(cfg, settings))
+	if err != nil {
+		return nil, err
+	}
+	storeCredential := credentials.Credential(store)
+	authorizer := &auth.Client{
+		Credential: func(ctx context.Context, hostport string) (auth.Credential, error) {
+			hostport = mirrors.registryHost(ctx, hostport)
+			if cred, ok := creds.registryCredential(hostport); ok {
+				return cred, nil
+			}
+			return storeCredential(ctx, hostport)
+		},
+	}
+	if mirrors.hasRegistries() {
+		// The auth cache is not used since it is keyed by the original registry host
+		authorizer.Client = &http.Client{Transport: &registryTransport{http.DefaultTransport, mirrors}}
+	} else {
+		authorizer.Cache = auth.NewCache()
+	}
+	return authorizer, nil
+}
+
+// registryConfigFile returns the configured registry config file path or helm's default.
+func registryConfigFile(cfg *config.LoaderConfig, settings *cli.EnvSettings) string {
+	if cfg.RegistryConfig != "" {
+		return cfg.RegistryConfig
+	}
+	return settings.RegistryConfig
+}
+
+// newCredentialsStore loads the registry credentials from the given file with fallback to docker's config.
+func newCredentialsStore(registryConfig string) (credentials.Store, error) {
+	storeOpts := credentials.StoreOptions{DetectDefaultNativeStore: true}
+	store, err := credentials.NewStore(registryConfig, storeOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "load registry credentials")
+	}
+	if dockerStore, err := credentials.NewStoreFromDocker(storeOpts); err == nil {
+		return credentials.NewStoreWithFallbacks(store, dockerStore), nil
+	}
+	return store, nil
+}
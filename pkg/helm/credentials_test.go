@@ -0,0 +1,96 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestRenderRepositoryCredentialsFromEnvAndFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-credentials-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ch, err := loader.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	fakeChartTgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	origHelmHome := os.Getenv("HELM_HOME")
+	err = os.Setenv("HELM_HOME", tmpDir)
+	require.NoError(t, err)
+	defer os.Setenv("HELM_HOME", origHelmHome)
+
+	for i, c := range []struct {
+		name  string
+		setup func(t *testing.T, entry *repo.Entry, cfg *config.ChartConfig)
+		valid bool
+	}{
+		{"env", func(t *testing.T, entry *repo.Entry, _ *config.ChartConfig) {
+			u, err := url.Parse(entry.URL)
+			require.NoError(t, err)
+			envPrefix := "KHELM_REPO_" + hostEnvName(u.Host)
+			t.Setenv(envPrefix+"_USERNAME", entry.Username)
+			t.Setenv(envPrefix+"_PASSWORD", entry.Password)
+		}, true},
+		{"file", func(t *testing.T, entry *repo.Entry, cfg *config.ChartConfig) {
+			f := repo.NewFile()
+			f.Add(entry)
+			credentialsFile := filepath.Join(tmpDir, "credentials.yaml")
+			b, err := yaml.Marshal(f)
+			require.NoError(t, err)
+			err = os.WriteFile(credentialsFile, b, 0600)
+			require.NoError(t, err)
+			cfg.CredentialsFile = credentialsFile
+		}, true},
+		{"none", func(*testing.T, *repo.Entry, *config.ChartConfig) {}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.NewChartConfig()
+			cfg.Chart = "private-chart"
+			cfg.Name = "myrelease"
+			cfg.Version = fmt.Sprintf("0.0.%d%d", time.Now().Unix(), i)
+			cfg.BaseDir = rootDir
+			entry := &repo.Entry{Name: "myprivaterepo", Username: "fakeuser", Password: "fakepassword"}
+			srv := httptest.NewServer(&fakePrivateChartServerHandler{entry, &cfg.LoaderConfig, fakeChartTgz, "0000000000000000"})
+			defer srv.Close()
+			entry.URL = srv.URL
+			cfg.Repository = srv.URL
+			c.setup(t, entry, cfg)
+
+			err := render(t, *cfg, true, &bytes.Buffer{})
+			if c.valid {
+				require.NoError(t, err, "render chart using credentials")
+			} else {
+				require.Error(t, err, "render chart without credentials")
+			}
+		})
+	}
+}
+
+func TestRegistryCredential(t *testing.T) {
+	creds := &repositoryCredentials{entries: map[string]*repo.Entry{
+		"oci://registry.example.org": {URL: "oci://registry.example.org", Username: "fileuser", Password: "filepassword"},
+	}}
+	t.Setenv("KHELM_REPO_OTHER_REGISTRY_EXAMPLE_ORG_5000_USERNAME", "envuser")
+	t.Setenv("KHELM_REPO_OTHER_REGISTRY_EXAMPLE_ORG_5000_PASSWORD", "envpassword")
+	cred, ok := creds.registryCredential("registry.example.org")
+	require.True(t, ok, "file credentials found")
+	require.Equal(t, "fileuser", cred.Username)
+	cred, ok = creds.registryCredential("other-registry.example.org:5000")
+	require.True(t, ok, "env credentials found")
+	require.Equal(t, "envuser", cred.Username)
+	require.Equal(t, "envpassword", cred.Password)
+	_, ok = creds.registryCredential("unknown.example.org")
+	require.False(t, ok, "unknown registry credentials found")
+}
@@ -0,0 +1,142 @@
+package helm
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/cli"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	// DefaultImageDigestMaxAge is the default duration a resolved image digest is cached for
+	DefaultImageDigestMaxAge = 24 * time.Hour
+)
+
+// imageDigestResolver resolves image tags to digests using the registry credentials and mirrors helm's registry client uses.
+// Resolved digests are cached within the khelm cache dir for the given max age since tags are mutable.
+type imageDigestResolver struct {
+	cacheDir string
+	maxAge   time.Duration
+	client   *auth.Client
+	mirrors  Mirrors
+}
+
+func newImageDigestResolver(cfg *config.LoaderConfig, settings *cli.EnvSettings, mirrors Mirrors, maxAge time.Duration) (*imageDigestResolver, error) {
+	client, err := newRegistryAuthorizer(cfg, settings, mirrors)
+	if err != nil {
+		return nil, err
+	}
+	return &imageDigestResolver{
+		cacheDir: filepath.Join(settings.RepositoryCache, "khelm", "image-digests"),
+		maxAge:   maxAge,
+		client:   client,
+		mirrors:  mirrors,
+	}, nil
+}
+
+// ResolveDigests pins the images of the given resources' containers to their digest.
+// Images that are configurable using a setter are not pinned since the digest would contradict the setter.
+func (r *imageDigestResolver) ResolveDigests(ctx context.Context, resources []*yaml.RNode) error {
+	for _, o := range resources {
+		err := visitImages(o, func(image *yaml.RNode) error {
+			name, tag, digest := splitImage(image.YNode().Value)
+			if digest != "" {
+				return nil
+			}
+			if strings.HasPrefix(image.YNode().LineComment, setterCommentPrefix) {
+				log.Printf("Not resolving the digest of image %s within %s %s since it is configurable using a setter", image.YNode().Value, o.GetKind(), o.GetName())
+				return nil
+			}
+			digest, err := r.resolve(ctx, name, tag)
+			if err != nil {
+				return err
+			}
+			return image.PipeE(yaml.FieldSetter{StringValue: joinImage(name, tag, digest)})
+		})
+		if err != nil {
+			return errors.Wrapf(err, "resolve image digests of %s %s", o.GetKind(), o.GetName())
+		}
+	}
+	return nil
+}
+
+func (r *imageDigestResolver) resolve(ctx context.Context, name, tag string) (string, error) {
+	if tag == "" {
+		tag = "latest"
+	}
+	ref := fmt.Sprintf("%s:%s", name, tag)
+	cacheFile := filepath.Join(r.cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(ref))))
+	if isFileFresh(cacheFile, r.maxAge) {
+		if b, err := os.ReadFile(cacheFile); err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	repo, err := remote.NewRepository(registryRepository(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve image %s", ref)
+	}
+	repo.Client = r.client
+	registryHost := repo.Reference.Registry
+	if u := r.mirrors.registryURL(&url.URL{Host: registryHost, Path: registryAPIPrefix + repo.Reference.Repository}); u != nil {
+		registryHost = u.Host
+	}
+	repo.PlainHTTP = isLoopbackHost(registryHost)
+	desc, err := repo.Resolve(ctx, tag)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve image %s", ref)
+	}
+	digest := desc.Digest.String()
+	log.Printf("Resolved image %s to digest %s", ref, digest)
+	if err = os.MkdirAll(r.cacheDir, 0750); err != nil {
+		return "", errors.Wrap(err, "create image digest cache dir")
+	}
+	tmpFile := fmt.Sprintf("%s.%d.tmp", cacheFile, os.Getpid())
+	if err = os.WriteFile(tmpFile, []byte(digest), 0640); err != nil {
+		return "", errors.Wrap(err, "write image digest cache")
+	}
+	return digest, errors.Wrap(os.Rename(tmpFile, cacheFile), "write image digest cache")
+}
+
+// registryRepository expands the given image name to a fully qualified repository name the way docker does.
+func registryRepository(name string) string {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return fmt.Sprintf("%s/library/%s", dockerHubRegistry, name)
+	}
+	host := name[:i]
+	if host == "docker.io" || host == "index.docker.io" {
+		return dockerHubRegistry + name[i:]
+	}
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return fmt.Sprintf("%s/%s", dockerHubRegistry, name)
+	}
+	return name
+}
+
+// isLoopbackHost returns true if the given registry runs on the local host.
+// Like docker khelm accesses local registries via plain HTTP.
+func isLoopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
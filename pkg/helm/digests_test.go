@@ -0,0 +1,142 @@
+package helm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/cli"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestImageDigestResolver(t *testing.T) {
+	digest := "sha256:24a0c4b4a4c0eb97a1aabb8e29f18e917d05abfe1b7a7c07857230879ce7d3d3"
+	requests := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.URL.Path != "/v2/myorg/app/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", "512")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	dir := t.TempDir()
+	settings := cli.New()
+	settings.RegistryConfig = filepath.Join(dir, "registry", "config.json")
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	manifest := `apiVersion: v1
+kind: Pod
+metadata:
+  name: mypod
+spec:
+  containers:
+  - name: app
+    image: ` + host + `/myorg/app:1.0
+  - name: pinned
+    image: alpine:3.13@` + digest + `
+`
+	for _, cached := range []string{"", "cached "} {
+		resolver, err := newImageDigestResolver(&config.LoaderConfig{}, settings, nil, time.Hour)
+		require.NoError(t, err)
+		o, err := yaml.Parse(manifest)
+		require.NoError(t, err)
+		err = resolver.ResolveDigests(context.Background(), []*yaml.RNode{o})
+		require.NoError(t, err, "%sresolve", cached)
+		images, err := Images([]*yaml.RNode{o})
+		require.NoError(t, err)
+		require.Equal(t, []string{host + "/myorg/app:1.0@" + digest, "alpine:3.13@" + digest}, images, "%simages", cached)
+		require.Equal(t, 1, requests, "%sregistry requests", cached)
+	}
+
+	// Refresh expired digest
+	cacheFiles, err := filepath.Glob(filepath.Join(settings.RepositoryCache, "khelm", "image-digests", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cacheFiles), "digest cache files")
+	expired := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(cacheFiles[0], expired, expired)
+	require.NoError(t, err)
+	digest = "sha256:a8c5b4bd5f7ab3d2fa9ff3b2b2ae1a39bb9a5c2b9f1d8e34e2b7c1f5d0e9a4b1"
+	resolver, err := newImageDigestResolver(&config.LoaderConfig{}, settings, nil, time.Hour)
+	require.NoError(t, err)
+	o, err := yaml.Parse(manifest)
+	require.NoError(t, err)
+	err = resolver.ResolveDigests(context.Background(), []*yaml.RNode{o})
+	require.NoError(t, err, "resolve expired")
+	images, err := Images([]*yaml.RNode{o})
+	require.NoError(t, err)
+	require.Equal(t, host+"/myorg/app:1.0@"+digest, images[0], "refreshed image")
+	require.Equal(t, 2, requests, "registry requests after expiry")
+
+	resolver, err = newImageDigestResolver(&config.LoaderConfig{}, settings, nil, time.Hour)
+	require.NoError(t, err)
+	o, err = yaml.Parse(strings.ReplaceAll(manifest, "myorg/app:1.0", "myorg/app:2.0"))
+	require.NoError(t, err)
+	err = resolver.ResolveDigests(context.Background(), []*yaml.RNode{o})
+	require.Error(t, err, "resolve unknown tag")
+}
+
+func TestImageDigestResolverCredentialsAndMirrors(t *testing.T) {
+	digest := "sha256:24a0c4b4a4c0eb97a1aabb8e29f18e917d05abfe1b7a7c07857230879ce7d3d3"
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "fakeuser" || password != "fakepassword" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/v2/mirror/myorg/app/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", "512")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	dir := t.TempDir()
+	settings := cli.New()
+	settings.RegistryConfig = filepath.Join(dir, "registry", "config.json")
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	// The credentials of the mirror are used
+	t.Setenv("KHELM_REPO_"+hostEnvName(host)+"_USERNAME", "fakeuser")
+	t.Setenv("KHELM_REPO_"+hostEnvName(host)+"_PASSWORD", "fakepassword")
+	mirrors := Mirrors{{Prefix: "oci://registry.example.org", Replacement: "oci://" + host + "/mirror"}}
+	resolver, err := newImageDigestResolver(&config.LoaderConfig{}, settings, mirrors, time.Hour)
+	require.NoError(t, err)
+	o, err := yaml.Parse("apiVersion: v1\nkind: Pod\nmetadata:\n  name: mypod\nspec:\n  containers:\n  - name: app\n    image: registry.example.org/myorg/app:1.0\n")
+	require.NoError(t, err)
+	err = resolver.ResolveDigests(context.Background(), []*yaml.RNode{o})
+	require.NoError(t, err)
+	images, err := Images([]*yaml.RNode{o})
+	require.NoError(t, err)
+	require.Equal(t, []string{"registry.example.org/myorg/app:1.0@" + digest}, images)
+}
+
+func TestRegistryRepository(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		expected string
+	}{
+		{"alpine", "registry-1.docker.io/library/alpine"},
+		{"myorg/app", "registry-1.docker.io/myorg/app"},
+		{"docker.io/myorg/app", "registry-1.docker.io/myorg/app"},
+		{"quay.io/myorg/app", "quay.io/myorg/app"},
+		{"localhost/app", "localhost/app"},
+		{"localhost:5000/app", "localhost:5000/app"},
+	} {
+		require.Equal(t, c.expected, registryRepository(c.name), c.name)
+	}
+}
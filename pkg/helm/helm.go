@@ -3,6 +3,7 @@ package helm
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/getter"
@@ -12,8 +13,12 @@ import (
 // Helm maintains the helm environment state
 type Helm struct {
 	TrustAnyRepository *bool
+	TrustPolicy        *TrustPolicy
 	Settings           cli.EnvSettings
 	Getters            getter.Providers
+	Mirrors            Mirrors
+	IndexMaxAge        time.Duration
+	ImageDigestMaxAge  time.Duration
 }
 
 // NewHelm creates a new helm environment
@@ -23,5 +28,10 @@ func NewHelm() *Helm {
 		// Fallback for old helm env var
 		settings.RepositoryConfig = filepath.Join(helmHome, "repository", "repositories.yaml")
 	}
-	return &Helm{Settings: *settings, Getters: getter.All(settings)}
+	return &Helm{Settings: *settings, Getters: getter.All(settings), ImageDigestMaxAge: DefaultImageDigestMaxAge}
+}
+
+// loaderGetters returns the getters that are used to load charts and repository indices (from the configured mirrors).
+func (h *Helm) loaderGetters(creds *repositoryCredentials) getter.Providers {
+	return h.Mirrors.Getters(h.Getters, creds)
 }
@@ -0,0 +1,356 @@
+package helm
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	annotationHelmHookWeight         = "helm.sh/hook-weight"
+	annotationHelmHookDeletePolicy   = "helm.sh/hook-delete-policy"
+	annotationArgoCDHook             = "argocd.argoproj.io/hook"
+	annotationArgoCDHookDeletePolicy = "argocd.argoproj.io/hook-delete-policy"
+	annotationArgoCDSyncWave         = "argocd.argoproj.io/sync-wave"
+	annotationKptDependsOn           = "config.kubernetes.io/depends-on"
+)
+
+var (
+	// argoCDHooks maps helm hook types to Argo CD hook types.
+	// See https://argo-cd.readthedocs.io/en/stable/user-guide/helm/#helm-hooks
+	argoCDHooks = map[string]string{
+		"pre-install":  "PreSync",
+		"pre-upgrade":  "PreSync",
+		"post-install": "PostSync",
+		"post-upgrade": "PostSync",
+		"post-delete":  "PostDelete",
+	}
+	argoCDHookDeletePolicies = map[string]string{
+		"before-hook-creation": "BeforeHookCreation",
+		"hook-succeeded":       "HookSucceeded",
+		"hook-failed":          "HookFailed",
+	}
+	kptPreApplyHooks  = map[string]bool{"pre-install": true, "pre-upgrade": true}
+	kptPostApplyHooks = map[string]bool{"post-install": true, "post-upgrade": true}
+)
+
+// hookHandler applies the configured policies to chart hooks
+type hookHandler struct {
+	config.HookConfig
+	ExcludeByDefault bool
+	// Conversion specifies the format the kept hooks are converted into
+	Conversion string
+	// Namespace is the namespace that resources without namespace are applied to
+	Namespace string
+}
+
+// hookResource is a resource along with its hook types and weight
+type hookResource struct {
+	*yaml.RNode
+	Meta         yaml.ResourceMeta
+	DependencyID string
+	Hooks        []string
+	Weight       int
+	HasWeight    bool
+}
+
+func (h *hookHandler) policy(hook string) string {
+	if p := h.Policies[hook]; p != "" {
+		return p
+	}
+	if h.ExcludeByDefault {
+		return config.HookPolicyExclude
+	}
+	return config.HookPolicyKeep
+}
+
+// Excludes returns true if hooks of the given type should be excluded
+func (h *hookHandler) Excludes(hook string) bool {
+	return h.policy(hook) == config.HookPolicyExclude
+}
+
+// OutputHooks returns the provided hook types that remain chart hooks within the output.
+// Kept hooks are converted when a conversion is configured, except for test hooks.
+func (h *hookHandler) OutputHooks(hooks []string) []string {
+	kept := make([]string, 0, len(hooks))
+	for _, hook := range hooks {
+		if h.policy(hook) == config.HookPolicyKeep && (h.Conversion == "" || slices.Contains(config.TestHookTypes, hook)) {
+			kept = append(kept, hook)
+		}
+	}
+	return kept
+}
+
+// resourcePolicy returns the policy that applies to a resource with the given hook types.
+// Keeping a hook precedes converting it which precedes excluding it.
+func (h *hookHandler) resourcePolicy(hooks []string) string {
+	policy := config.HookPolicyExclude
+	for _, hook := range hooks {
+		switch h.policy(hook) {
+		case config.HookPolicyKeep:
+			return config.HookPolicyKeep
+		case config.HookPolicyConvert:
+			policy = config.HookPolicyConvert
+		}
+	}
+	return policy
+}
+
+// Transform converts hooks into plain resources or other tools' hooks according to the configured policies
+func (h *hookHandler) Transform(resources []manifestResource) error {
+	converted := make([]hookResource, 0)
+	kept := make([]hookResource, 0)
+	plain := make([]hookResource, 0, len(resources))
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return err
+		}
+		hook, err := newHookResource(o.RNode, meta, h.Namespace)
+		if err != nil {
+			return err
+		}
+		if len(hook.Hooks) == 0 {
+			plain = append(plain, hook)
+			continue
+		}
+		switch h.resourcePolicy(hook.Hooks) {
+		case config.HookPolicyConvert:
+			if err = removeHookAnnotations(o.RNode, meta.Annotations); err != nil {
+				return errors.Wrapf(err, "convert hook %s %s", meta.Kind, meta.Name)
+			}
+			converted = append(converted, hook)
+		case config.HookPolicyKeep:
+			if !config.IsTestHook(hook.Hooks) {
+				kept = append(kept, hook)
+			}
+		}
+	}
+	err := convertHookWeights(converted, h.WeightConversion)
+	if err != nil {
+		return err
+	}
+	switch h.Conversion {
+	case config.HookConversionArgoCD:
+		return convertHooksToArgoCD(kept)
+	case config.HookConversionKpt:
+		return convertHooksToKpt(kept, append(plain, converted...))
+	}
+	return nil
+}
+
+func newHookResource(o *yaml.RNode, meta yaml.ResourceMeta, namespace string) (hookResource, error) {
+	r := hookResource{RNode: o, Meta: meta, DependencyID: kptDependencyID(&meta, namespace), Hooks: matcher.HookTypes(&meta)}
+	if w := strings.TrimSpace(meta.Annotations[annotationHelmHookWeight]); w != "" {
+		weight, err := strconv.Atoi(w)
+		if err != nil {
+			return r, errors.Errorf("invalid %s annotation value %q on %s %s", annotationHelmHookWeight, w, meta.Kind, meta.Name)
+		}
+		r.Weight = weight
+		r.HasWeight = true
+	}
+	return r, nil
+}
+
+// removeHookAnnotations removes all helm.sh/hook* annotations from the given resource
+func removeHookAnnotations(o *yaml.RNode, annotations map[string]string) error {
+	for k := range annotations {
+		if strings.HasPrefix(k, matcher.AnnotationHelmHook) {
+			if err := o.PipeE(yaml.ClearAnnotation(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return o.PipeE(yaml.Lookup(yaml.MetadataField), yaml.FieldClearer{Name: yaml.AnnotationsField, IfEmpty: true})
+}
+
+// convertHookWeights translates the hook weights into annotations of the given format
+func convertHookWeights(hooks []hookResource, format string) error {
+	switch format {
+	case config.HookConversionArgoCD:
+		for _, h := range hooks {
+			if h.HasWeight {
+				if err := setAnnotation(h.RNode, annotationArgoCDSyncWave, strconv.Itoa(h.Weight)); err != nil {
+					return errors.Wrapf(err, "set %s annotation", annotationArgoCDSyncWave)
+				}
+			}
+		}
+	case config.HookConversionKpt:
+		_, err := setKptDependencies(hooks, nil)
+		return err
+	}
+	return nil
+}
+
+// setKptDependencies makes each resource depend on the resources with the next lower weight.
+// The resources with the lowest weight depend on the provided initial dependencies.
+// The references to the resources with the highest weight are returned.
+func setKptDependencies(hooks []hookResource, initialDeps []string) (lastDeps []string, err error) {
+	byWeight := map[int][]string{}
+	weights := make([]int, 0, len(hooks))
+	for _, h := range hooks {
+		if _, ok := byWeight[h.Weight]; !ok {
+			weights = append(weights, h.Weight)
+		}
+		byWeight[h.Weight] = append(byWeight[h.Weight], h.DependencyID)
+	}
+	sort.Ints(weights)
+	for _, deps := range byWeight {
+		sort.Strings(deps)
+	}
+	for _, h := range hooks {
+		deps := initialDeps
+		if i := sort.SearchInts(weights, h.Weight); i > 0 {
+			deps = byWeight[weights[i-1]]
+		}
+		if err = addKptDependencies(h.RNode, deps); err != nil {
+			return nil, err
+		}
+	}
+	if len(weights) > 0 {
+		lastDeps = byWeight[weights[len(weights)-1]]
+	}
+	return lastDeps, nil
+}
+
+// addKptDependencies adds the given resource references to the resource's depends-on annotation unless it contains them already
+func addKptDependencies(o *yaml.RNode, deps []string) error {
+	if len(deps) == 0 {
+		return nil
+	}
+	merged := []string{}
+	if existing := o.GetAnnotations()[annotationKptDependsOn]; existing != "" {
+		merged = strings.Split(existing, ",")
+	}
+	for _, dep := range deps {
+		if !slices.Contains(merged, dep) {
+			merged = append(merged, dep)
+		}
+	}
+	err := setAnnotation(o, annotationKptDependsOn, strings.Join(merged, ","))
+	return errors.Wrapf(err, "set %s annotation", annotationKptDependsOn)
+}
+
+// convertHooksToArgoCD maps helm hook annotations to the corresponding Argo CD annotations
+func convertHooksToArgoCD(hooks []hookResource) error {
+	unsupported := []string{}
+	for _, h := range hooks {
+		argoHooks := []string{}
+		dropped := []string{}
+		for _, hook := range h.Hooks {
+			argoHook := argoCDHooks[hook]
+			if argoHook == "" {
+				dropped = append(dropped, hook)
+			} else if !slices.Contains(argoHooks, argoHook) {
+				argoHooks = append(argoHooks, argoHook)
+			}
+		}
+		if len(argoHooks) == 0 {
+			unsupported = append(unsupported, fmt.Sprintf("%s %s (%s)", h.Meta.Kind, h.Meta.Name, strings.Join(h.Hooks, ",")))
+			continue
+		}
+		if len(dropped) > 0 {
+			log.Printf("WARNING: dropping hook types %s of %s %s since Argo CD does not support them", strings.Join(dropped, ","), h.Meta.Kind, h.Meta.Name)
+		}
+		deletePolicies := []string{}
+		for _, p := range strings.Split(h.Meta.Annotations[annotationHelmHookDeletePolicy], ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				if argoPolicy := argoCDHookDeletePolicies[p]; argoPolicy != "" {
+					deletePolicies = append(deletePolicies, argoPolicy)
+				}
+			}
+		}
+		err := removeHookAnnotations(h.RNode, h.Meta.Annotations)
+		if err != nil {
+			return errors.Wrapf(err, "convert hook %s %s", h.Meta.Kind, h.Meta.Name)
+		}
+		annotations := [][2]string{{annotationArgoCDHook, strings.Join(argoHooks, ",")}}
+		if h.HasWeight {
+			annotations = append(annotations, [2]string{annotationArgoCDSyncWave, strconv.Itoa(h.Weight)})
+		}
+		if len(deletePolicies) > 0 {
+			annotations = append(annotations, [2]string{annotationArgoCDHookDeletePolicy, strings.Join(deletePolicies, ",")})
+		}
+		for _, a := range annotations {
+			if err = setAnnotation(h.RNode, a[0], a[1]); err != nil {
+				return errors.Wrapf(err, "convert hook %s %s", h.Meta.Kind, h.Meta.Name)
+			}
+		}
+	}
+	return unsupportedHooksError(unsupported, config.HookConversionArgoCD)
+}
+
+// convertHooksToKpt converts pre-install/upgrade hooks into resources the other resources depend on
+// and post-install/upgrade hooks into resources that depend on the other resources.
+func convertHooksToKpt(hooks, resources []hookResource) error {
+	unsupported := []string{}
+	pre := make([]hookResource, 0, len(hooks))
+	post := make([]hookResource, 0, len(hooks))
+	for _, h := range hooks {
+		if containsOnly(h.Hooks, kptPreApplyHooks) {
+			pre = append(pre, h)
+		} else if containsOnly(h.Hooks, kptPostApplyHooks) {
+			post = append(post, h)
+		} else {
+			unsupported = append(unsupported, fmt.Sprintf("%s %s (%s)", h.Meta.Kind, h.Meta.Name, strings.Join(h.Hooks, ",")))
+			continue
+		}
+		if err := removeHookAnnotations(h.RNode, h.Meta.Annotations); err != nil {
+			return errors.Wrapf(err, "convert hook %s %s", h.Meta.Kind, h.Meta.Name)
+		}
+	}
+	if err := unsupportedHooksError(unsupported, config.HookConversionKpt); err != nil {
+		return err
+	}
+	preDeps, err := setKptDependencies(pre, nil)
+	if err != nil {
+		return err
+	}
+	resourceIDs := make([]string, len(resources))
+	for i, o := range resources {
+		resourceIDs[i] = o.DependencyID
+		if err = addKptDependencies(o.RNode, preDeps); err != nil {
+			return err
+		}
+	}
+	_, err = setKptDependencies(post, resourceIDs)
+	return err
+}
+
+func unsupportedHooksError(unsupported []string, format string) error {
+	if len(unsupported) > 0 {
+		return errors.Errorf("cannot convert the following hooks to %s:\n * %s\nPlease exclude them using hooks.policies",
+			format, strings.Join(unsupported, "\n * "))
+	}
+	return nil
+}
+
+func containsOnly(hooks []string, allowed map[string]bool) bool {
+	for _, hook := range hooks {
+		if !allowed[hook] {
+			return false
+		}
+	}
+	return true
+}
+
+// kptDependencyID returns the resource reference format used within kpt's depends-on annotation.
+// Namespaced resources without namespace are referred to within the namespace they are applied to.
+func kptDependencyID(meta *yaml.ResourceMeta, namespace string) string {
+	group := ""
+	if i := strings.Index(meta.APIVersion, "/"); i > 0 {
+		group = meta.APIVersion[:i]
+	}
+	if namespace = effectiveNamespace(meta, namespace); namespace != "" {
+		return fmt.Sprintf("%s/namespaces/%s/%s/%s", group, namespace, meta.Kind, meta.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", group, meta.Kind, meta.Name)
+}
@@ -0,0 +1,288 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const hooksManifest = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: pre-install-a
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-weight: "-5"
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: pre-install-b
+  namespace: myns
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-weight: "-5"
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: pre-install-c
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+    helm.sh/hook-weight: "3"
+    helm.sh/hook-delete-policy: hook-succeeded
+    other: annotation
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: post-upgrade
+  annotations:
+    helm.sh/hook: post-upgrade
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+  annotations:
+    helm.sh/hook: test
+`
+
+func TestHookPolicies(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		hooks         config.HookConfig
+		excludeHooks  bool
+		expectedNames []string
+		contained     []string
+		notContained  []string
+	}{
+		{
+			"keep by default",
+			config.HookConfig{},
+			false,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c", "post-upgrade", "test"},
+			[]string{"helm.sh/hook: pre-install\n"},
+			nil,
+		},
+		{
+			"exclude by default",
+			config.HookConfig{Policies: map[string]string{"pre-upgrade": config.HookPolicyKeep}},
+			true,
+			[]string{"myconfig", "pre-install-c"},
+			[]string{"helm.sh/hook: pre-install,pre-upgrade\n"},
+			nil,
+		},
+		{
+			"exclude test",
+			config.HookConfig{Policies: map[string]string{"test": config.HookPolicyExclude}},
+			false,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c", "post-upgrade"},
+			nil,
+			nil,
+		},
+		{
+			"convert",
+			config.HookConfig{Policies: map[string]string{"pre-install": config.HookPolicyConvert}},
+			true,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c"},
+			[]string{"  name: pre-install-c\n  annotations:\n    other: annotation\n"},
+			[]string{"helm.sh/hook", "sync-wave", "depends-on"},
+		},
+		{
+			"convert with argocd weights",
+			config.HookConfig{
+				Policies:         map[string]string{"pre-install": config.HookPolicyConvert, "pre-upgrade": config.HookPolicyConvert},
+				WeightConversion: config.HookConversionArgoCD,
+			},
+			true,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c"},
+			[]string{
+				"  name: pre-install-a\n  annotations:\n    argocd.argoproj.io/sync-wave: \"-5\"\n",
+				"    argocd.argoproj.io/sync-wave: \"3\"\n",
+			},
+			[]string{"helm.sh/hook"},
+		},
+		{
+			"convert with kpt weights",
+			config.HookConfig{
+				Policies:         map[string]string{"pre-install": config.HookPolicyConvert, "pre-upgrade": config.HookPolicyConvert},
+				WeightConversion: config.HookConversionKpt,
+			},
+			true,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c"},
+			[]string{"    config.kubernetes.io/depends-on: batch/namespaces/myns/Job/pre-install-b,batch/namespaces/release-ns/Job/pre-install-a\n"},
+			[]string{"helm.sh/hook"},
+		},
+		{
+			"keep hooks and convert weights of converted hooks",
+			config.HookConfig{
+				Policies:         map[string]string{"pre-install": config.HookPolicyConvert},
+				WeightConversion: config.HookConversionArgoCD,
+			},
+			false,
+			[]string{"myconfig", "pre-install-a", "pre-install-b", "pre-install-c", "post-upgrade", "test"},
+			[]string{
+				"  name: pre-install-a\n  annotations:\n    argocd.argoproj.io/sync-wave: \"-5\"\n",
+				"    helm.sh/hook: pre-install,pre-upgrade\n    helm.sh/hook-weight: \"3\"\n",
+				"    helm.sh/hook: post-upgrade\n",
+			},
+			[]string{"argocd.argoproj.io/hook", "argocd.argoproj.io/sync-wave: \"3\""},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			hooks := &hookHandler{HookConfig: c.hooks, ExcludeByDefault: c.excludeHooks, Namespace: "release-ns"}
+			testee := manifestTransformer{
+				Includes: matcher.Any(),
+				Excludes: matcher.NewChartHookMatcher(matcher.FromResourceSelectors(nil), hooks.Excludes),
+				Hooks:    hooks,
+			}
+			r, err := testee.TransformManifest(strings.NewReader(hooksManifest))
+			require.NoError(t, err)
+			names := make([]string, len(r))
+			out := ""
+			for i, o := range r {
+				names[i] = o.GetName()
+				out += o.MustString() + "---\n"
+			}
+			require.Equal(t, c.expectedNames, names, "resource names")
+			for _, s := range c.contained {
+				require.Contains(t, out, s)
+			}
+			for _, s := range c.notContained {
+				require.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestHookConversion(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		conversion   string
+		contained    []string
+		notContained []string
+	}{
+		{
+			"argocd",
+			config.HookConversionArgoCD,
+			[]string{
+				"  name: pre-install-a\n  annotations:\n    argocd.argoproj.io/hook: PreSync\n    argocd.argoproj.io/sync-wave: \"-5\"\n",
+				"    argocd.argoproj.io/sync-wave: \"3\"\n    argocd.argoproj.io/hook-delete-policy: HookSucceeded\n",
+				"  name: post-upgrade\n  annotations:\n    argocd.argoproj.io/hook: PostSync\n",
+				"  name: test\n  annotations:\n    helm.sh/hook: test\n",
+			},
+			[]string{"helm.sh/hook: pre", "helm.sh/hook: post", "helm.sh/hook-weight", "helm.sh/hook-delete-policy"},
+		},
+		{
+			"kpt",
+			config.HookConversionKpt,
+			[]string{
+				"  name: myconfig\n  annotations:\n    config.kubernetes.io/depends-on: batch/namespaces/release-ns/Job/pre-install-c\n",
+				"  name: pre-install-c\n  annotations:\n    other: annotation\n    config.kubernetes.io/depends-on: batch/namespaces/myns/Job/pre-install-b,batch/namespaces/release-ns/Job/pre-install-a\n",
+				"  name: post-upgrade\n  annotations:\n    config.kubernetes.io/depends-on: /namespaces/release-ns/ConfigMap/myconfig\n",
+			},
+			[]string{"helm.sh/hook: pre", "helm.sh/hook: post", "helm.sh/hook-weight", "helm.sh/hook-delete-policy"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			hooks := &hookHandler{Conversion: c.conversion, Namespace: "release-ns"}
+			testee := manifestTransformer{
+				Includes: matcher.Any(),
+				Excludes: matcher.NewChartHookMatcher(matcher.FromResourceSelectors(nil), hooks.Excludes),
+				Hooks:    hooks,
+			}
+			r, err := testee.TransformManifest(strings.NewReader(hooksManifest))
+			require.NoError(t, err)
+			out := ""
+			for _, o := range r {
+				out += o.MustString() + "---\n"
+			}
+			for _, s := range c.contained {
+				require.Contains(t, out, s)
+			}
+			for _, s := range c.notContained {
+				require.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestHookConversionUnsupported(t *testing.T) {
+	manifest := "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: rollback\n  annotations:\n    helm.sh/hook: pre-rollback\n"
+	for _, conversion := range []string{config.HookConversionArgoCD, config.HookConversionKpt} {
+		hooks := &hookHandler{Conversion: conversion}
+		testee := manifestTransformer{
+			Includes: matcher.Any(),
+			Excludes: matcher.NewChartHookMatcher(matcher.FromResourceSelectors(nil), hooks.Excludes),
+			Hooks:    hooks,
+		}
+		_, err := testee.TransformManifest(strings.NewReader(manifest))
+		require.Error(t, err, conversion)
+		require.Contains(t, err.Error(), "Job rollback (pre-rollback)", conversion)
+	}
+}
+
+func TestKptDependencyID(t *testing.T) {
+	for _, c := range []struct {
+		apiVersion string
+		kind       string
+		namespace  string
+		expected   string
+	}{
+		{"batch/v1", "Job", "", "batch/namespaces/release-ns/Job/myname"},
+		{"batch/v1", "Job", "other", "batch/namespaces/other/Job/myname"},
+		{"v1", "ConfigMap", "", "/namespaces/release-ns/ConfigMap/myname"},
+		{"rbac.authorization.k8s.io/v1", "ClusterRole", "", "rbac.authorization.k8s.io/ClusterRole/myname"},
+	} {
+		meta := yaml.ResourceMeta{TypeMeta: yaml.TypeMeta{APIVersion: c.apiVersion, Kind: c.kind}}
+		meta.Name = "myname"
+		meta.Namespace = c.namespace
+		require.Equal(t, c.expected, kptDependencyID(&meta, "release-ns"), "%s %s", c.kind, c.namespace)
+	}
+}
+
+func TestHookConversionKptDependenciesUnique(t *testing.T) {
+	manifest := `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  annotations:
+    config.kubernetes.io/depends-on: batch/namespaces/release-ns/Job/pre-install
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: pre-install
+  annotations:
+    helm.sh/hook: pre-install
+`
+	hooks := &hookHandler{Conversion: config.HookConversionKpt, Namespace: "release-ns"}
+	testee := manifestTransformer{
+		Includes: matcher.Any(),
+		Excludes: matcher.NewChartHookMatcher(matcher.FromResourceSelectors(nil), hooks.Excludes),
+		Hooks:    hooks,
+	}
+	r, err := testee.TransformManifest(strings.NewReader(manifest))
+	require.NoError(t, err)
+	require.Equal(t, "batch/namespaces/release-ns/Job/pre-install", r[0].GetAnnotations()[annotationKptDependsOn])
+}
+
+func TestHookHandlerOutputHooks(t *testing.T) {
+	found := []string{"pre-install", "post-install", "test"}
+	hooks := &hookHandler{HookConfig: config.HookConfig{Policies: map[string]string{"post-install": config.HookPolicyConvert}}}
+	require.Equal(t, []string{"pre-install", "test"}, hooks.OutputHooks(found), "without conversion")
+	hooks.Conversion = config.HookConversionArgoCD
+	require.Equal(t, []string{"test"}, hooks.OutputHooks(found), "with conversion")
+}
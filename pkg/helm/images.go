@@ -0,0 +1,126 @@
+package helm
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// podSpecFields lists the pod spec paths of the well-known workload kinds
+var podSpecFields = []struct{ Kind, Path string }{
+	{"Pod", "spec"},
+	{"Deployment", "spec/template/spec"},
+	{"StatefulSet", "spec/template/spec"},
+	{"DaemonSet", "spec/template/spec"},
+	{"ReplicaSet", "spec/template/spec"},
+	{"Job", "spec/template/spec"},
+	{"CronJob", "spec/jobTemplate/spec/template/spec"},
+}
+
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// applyImages replaces the container images according to the configured image overrides.
+func (t *manifestTransformer) applyImages(resources []manifestResource) error {
+	if len(t.Images) == 0 {
+		return nil
+	}
+	for _, o := range resources {
+		err := visitImages(o.RNode, func(image *yaml.RNode) error {
+			if newImage := overrideImage(image.YNode().Value, t.Images); newImage != image.YNode().Value {
+				return image.PipeE(yaml.FieldSetter{StringValue: newImage})
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "set image within %s %s", o.GetKind(), o.GetName())
+		}
+	}
+	return nil
+}
+
+// Images returns the distinct container images referenced within the given resources.
+func Images(resources []*yaml.RNode) ([]string, error) {
+	found := map[string]struct{}{}
+	for _, o := range resources {
+		err := visitImages(o, func(image *yaml.RNode) error {
+			found[image.YNode().Value] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "find images within %s %s", o.GetKind(), o.GetName())
+		}
+	}
+	images := make([]string, 0, len(found))
+	for image := range found {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// visitImages calls fn with the image field value node of each container within the given resource.
+func visitImages(o *yaml.RNode, fn func(image *yaml.RNode) error) error {
+	kind := o.GetKind()
+	for _, f := range podSpecFields {
+		if f.Kind != kind {
+			continue
+		}
+		for _, c := range containerFields {
+			path := append(strings.Split(f.Path, "/"), c, "image")
+			err := visitFields(o, path, func(_, image *yaml.RNode) error {
+				return fn(image)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overrideImage applies the first matching image override to the given image reference.
+func overrideImage(image string, overrides []config.Image) string {
+	name, tag, digest := splitImage(image)
+	for _, o := range overrides {
+		if o.Name != name {
+			continue
+		}
+		if o.NewName != "" {
+			name = o.NewName
+		}
+		if o.NewTag != "" {
+			tag = o.NewTag
+			digest = ""
+		}
+		if o.Digest != "" {
+			tag = ""
+			digest = o.Digest
+		}
+		return joinImage(name, tag, digest)
+	}
+	return image
+}
+
+// splitImage splits an image reference into name, tag and digest.
+func splitImage(image string) (name, tag, digest string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, digest = image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	return image, tag, digest
+}
+
+func joinImage(name, tag, digest string) string {
+	if tag != "" {
+		name += ":" + tag
+	}
+	if digest != "" {
+		name += "@" + digest
+	}
+	return name
+}
@@ -0,0 +1,77 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrideImage(t *testing.T) {
+	digest := "sha256:24a0c4b4a4c0eb97a1aabb8e29f18e917d05abfe1b7a7c07857230879ce7d3d3"
+	for _, c := range []struct {
+		image    string
+		override config.Image
+		expected string
+	}{
+		{"alpine", config.Image{Name: "alpine", NewTag: "3.14"}, "alpine:3.14"},
+		{"alpine:3.13", config.Image{Name: "alpine", NewName: "registry.example.org/alpine"}, "registry.example.org/alpine:3.13"},
+		{"alpine:3.13", config.Image{Name: "alpine", Digest: digest}, "alpine@" + digest},
+		{"alpine:3.13@" + digest, config.Image{Name: "alpine", NewTag: "3.14"}, "alpine:3.14"},
+		{"localhost:5000/app:1.0", config.Image{Name: "localhost:5000/app", NewName: "example.org/app", NewTag: "2.0"}, "example.org/app:2.0"},
+		{"localhost:5000/app", config.Image{Name: "localhost", NewTag: "2.0"}, "localhost:5000/app"},
+		{"other:1.0", config.Image{Name: "alpine", NewTag: "3.14"}, "other:1.0"},
+	} {
+		t.Run(c.image, func(t *testing.T) {
+			require.Equal(t, c.expected, overrideImage(c.image, []config.Image{c.override}))
+		})
+	}
+}
+
+func TestImages(t *testing.T) {
+	manifest := `---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: mycronjob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          initContainers:
+          - name: init
+            image: busybox:1.36
+          containers:
+          - name: job
+            image: alpine:3.13
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: example.org/app:1.0
+      - name: sidecar
+        image: alpine:3.13
+`
+	testee := manifestTransformer{
+		Images: []config.Image{
+			{Name: "alpine", NewTag: "3.14"},
+			{Name: "busybox", NewName: "registry.example.org/busybox"},
+		},
+		Includes: matcher.Any(),
+		Excludes: matcher.FromResourceSelectors(nil),
+	}
+	r, err := testee.TransformManifest(strings.NewReader(manifest))
+	require.NoError(t, err)
+	images, err := Images(r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alpine:3.14", "example.org/app:1.0", "registry.example.org/busybox:1.36"}, images)
+}
@@ -0,0 +1,275 @@
+package helm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// isFileFresh returns true if the cache file has been written or revalidated within the given max age.
+func isFileFresh(file string, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	fi, err := os.Stat(file)
+	return err == nil && time.Since(fi.ModTime()) < maxAge
+}
+
+// indexCacheInfo holds the HTTP cache validators of a downloaded repository index file.
+// The validators are only used as long as the index file's digest matches.
+type indexCacheInfo struct {
+	Digest       string `json:"digest"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func indexCacheInfoFile(idxFile string) string {
+	return idxFile + ".http.json"
+}
+
+// downloadHTTPIndexFile downloads a repository's index file from the given URL using a conditional request.
+// The entry provides the credentials and TLS configuration for the URL.
+// When the server responds that the index has not been modified the cached file is kept and its mtime is updated.
+func downloadHTTPIndexFile(ctx context.Context, indexURL string, entry *repo.Entry, idxFile string) error {
+	client, err := indexHTTPClient(entry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, indexURL, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if entry.Username != "" && entry.Password != "" {
+		req.SetBasicAuth(entry.Username, entry.Password)
+	}
+	infoFile := indexCacheInfoFile(idxFile)
+	if info := readIndexCacheInfo(infoFile); info.Digest != "" && info.Digest == digestOrEmpty(idxFile) {
+		if info.ETag != "" {
+			req.Header.Set("If-None-Match", info.ETag)
+		}
+		if info.LastModified != "" {
+			req.Header.Set("If-Modified-Since", info.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Printf("Repository index of %s has not been modified", entry.URL)
+		now := time.Now()
+		return errors.WithStack(os.Chtimes(idxFile, now, now))
+	case http.StatusOK:
+	default:
+		return errors.Errorf("failed to fetch %s : %s", indexURL, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "fetch %s", indexURL)
+	}
+	sum := sha256.Sum256(b)
+	digest := hex.EncodeToString(sum[:])
+	if err = writeIndexFile(b, digest, idxFile); err != nil {
+		return err
+	}
+	info := indexCacheInfo{Digest: digest, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	return writeIndexCacheInfo(infoFile, info)
+}
+
+// writeIndexFileIfChanged writes the downloaded index into the given file unless it equals the cached one.
+// An unchanged index file's mtime is updated to mark it as revalidated.
+// This is used for indices that are downloaded using getters which cannot send conditional requests.
+func writeIndexFileIfChanged(b []byte, idxFile, repoURL string) error {
+	sum := sha256.Sum256(b)
+	digest := hex.EncodeToString(sum[:])
+	if digest == digestOrEmpty(idxFile) {
+		log.Printf("Repository index of %s has not changed", repoURL)
+		now := time.Now()
+		return errors.WithStack(os.Chtimes(idxFile, now, now))
+	}
+	return writeIndexFile(b, digest, idxFile)
+}
+
+// writeIndexFile validates the index and writes it to the given file atomically.
+// The parsed index is cached as well since it is loaded afterwards anyway.
+func writeIndexFile(b []byte, digest, idxFile string) error {
+	err := os.MkdirAll(filepath.Dir(idxFile), 0750)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(idxFile), fmt.Sprintf(".tmp-%s", filepath.Base(idxFile)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpFileName := tmpFile.Name()
+	_, err = tmpFile.Write(b)
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	var idx *repo.IndexFile
+	if err == nil {
+		idx, err = repo.LoadIndexFile(tmpFileName)
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, idxFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		return errors.WithStack(err)
+	}
+	if err = writeParsedIndexCache(parsedIndexCacheFile(idxFile), digest, idx); err != nil {
+		log.Printf("WARNING: failed to cache parsed repository index: %s", err)
+	}
+	return nil
+}
+
+// fileDigest returns the file's SHA-256 digest.
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func digestOrEmpty(file string) string {
+	digest, _ := fileDigest(file)
+	return digest
+}
+
+func readIndexCacheInfo(file string) (info indexCacheInfo) {
+	b, err := os.ReadFile(file)
+	if err == nil {
+		_ = json.Unmarshal(b, &info)
+	}
+	return info
+}
+
+func writeIndexCacheInfo(file string, info indexCacheInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(file, b, 0640))
+}
+
+// indexHTTPClient creates an HTTP client using the repository's TLS configuration.
+func indexHTTPClient(entry *repo.Entry) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: entry.InsecureSkipTLSverify} // #nosec G402
+	if entry.CertFile != "" && entry.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(entry.CertFile, entry.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load client certificate for repository %s", entry.URL)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if entry.CAFile != "" {
+		caPEM, err := os.ReadFile(entry.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load CA certificate for repository %s", entry.URL)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no CA certificate found within %s", entry.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+const parsedIndexCacheHeader = "khelm-index-cache-v1"
+
+func parsedIndexCacheFile(idxFile string) string {
+	return idxFile + ".parsed.json"
+}
+
+// loadCachedIndexFile loads a repository index file.
+// Since parsing large YAML index files is slow, the parsed index is cached as JSON
+// next to the index file and reused as long as the index file's digest does not change.
+func loadCachedIndexFile(idxFile string) (*repo.IndexFile, error) {
+	digest, err := fileDigest(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := parsedIndexCacheFile(idxFile)
+	if idx := readParsedIndexCache(cacheFile, digest); idx != nil {
+		return idx, nil
+	}
+	idx, err := repo.LoadIndexFile(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeParsedIndexCache(cacheFile, digest, idx); err != nil {
+		log.Printf("WARNING: failed to cache parsed repository index: %s", err)
+	}
+	return idx, nil
+}
+
+// readParsedIndexCache returns the cached index or nil if the cache does not exist or does not match the digest.
+func readParsedIndexCache(cacheFile, digest string) *repo.IndexFile {
+	f, err := os.Open(cacheFile)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil || header != fmt.Sprintf("%s %s\n", parsedIndexCacheHeader, digest) {
+		return nil
+	}
+	idx := &repo.IndexFile{}
+	if err = json.NewDecoder(r).Decode(idx); err != nil {
+		return nil
+	}
+	return idx
+}
+
+func writeParsedIndexCache(cacheFile, digest string, idx *repo.IndexFile) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(cacheFile), fmt.Sprintf(".tmp-%s", filepath.Base(cacheFile)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpFileName := tmpFile.Name()
+	w := bufio.NewWriter(tmpFile)
+	_, err = fmt.Fprintf(w, "%s %s\n", parsedIndexCacheHeader, digest)
+	if err == nil {
+		err = json.NewEncoder(w).Encode(idx)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := tmpFile.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, cacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		return errors.WithStack(err)
+	}
+	return nil
+}
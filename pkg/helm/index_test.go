@@ -0,0 +1,289 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestRepositoryIndexConditionalUpdate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-index-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	idxSrcFile := filepath.Join(tmpDir, "index.yaml")
+	writeFakeIndexFile(t, idxSrcFile, 1, 1)
+	var downloads, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/index.yaml", r.URL.Path, "request path")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, idxSrcFile)
+	}))
+	defer srv.Close()
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(tmpDir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(tmpDir, "cache")
+	trust := true
+	newRepos := func(maxAge time.Duration) repositoryConfig {
+		opts := repositoryOptions{trustAnyRepo: &trust, creds: &repositoryCredentials{}, indexMaxAge: maxAge}
+		repos, err := reposForURLs(map[string]struct{}{srv.URL: {}}, opts, settings, getter.All(settings))
+		require.NoError(t, err, "reposForURLs()")
+		return repos
+	}
+	ctx := context.Background()
+
+	repos := newRepos(0)
+	err = repos.UpdateIndex(ctx, []string{srv.URL})
+	require.NoError(t, err, "initial UpdateIndex()")
+	require.Equal(t, int32(1), downloads, "downloads after initial update")
+	entry, err := repos.Get(srv.URL)
+	require.NoError(t, err)
+	idxFile := indexFile(entry, settings.RepositoryCache)
+	parsedInfo, err := os.Stat(parsedIndexCacheFile(idxFile))
+	require.NoError(t, err, "parsed index should be cached after download")
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(idxFile, past, past)
+	require.NoError(t, err)
+
+	err = newRepos(0).UpdateIndex(ctx, []string{srv.URL})
+	require.NoError(t, err, "UpdateIndex() of unmodified index")
+	require.Equal(t, int32(1), downloads, "downloads after unmodified update")
+	require.Equal(t, int32(1), notModified, "not modified responses")
+	require.True(t, isFileFresh(idxFile, time.Hour), "unmodified index file should be marked as revalidated")
+	fi, err := os.Stat(parsedIndexCacheFile(idxFile))
+	require.NoError(t, err)
+	require.Equal(t, parsedInfo.ModTime(), fi.ModTime(), "parsed index cache of unmodified index should be kept")
+
+	err = newRepos(time.Hour).UpdateIndex(ctx, []string{srv.URL})
+	require.NoError(t, err, "UpdateIndex() within max age")
+	require.Equal(t, int32(1), downloads, "downloads within max age")
+	require.Equal(t, int32(1), notModified, "not modified responses within max age")
+
+	repos = newRepos(time.Hour)
+	err = repos.RefreshIndex(ctx, []string{srv.URL})
+	require.NoError(t, err, "RefreshIndex()")
+	require.Equal(t, int32(2), notModified, "not modified responses after refresh")
+	cv, err := repos.ResolveChartVersion(ctx, "chart-0", "1.0.0", srv.URL)
+	require.NoError(t, err, "ResolveChartVersion()")
+	require.Equal(t, "1.0.0", cv.Version, "resolved version")
+
+	// Modified cache file must not be revalidated
+	err = repo.NewIndexFile().WriteFile(idxFile, 0644)
+	require.NoError(t, err)
+	err = newRepos(0).UpdateIndex(ctx, []string{srv.URL})
+	require.NoError(t, err, "UpdateIndex() after cache file modification")
+	require.Equal(t, int32(2), downloads, "downloads after cache file modification")
+}
+
+func TestRepositoryIndexUpdateMirror(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-index-mirror-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	idxSrcFile := filepath.Join(tmpDir, "index.yaml")
+	writeFakeIndexFile(t, idxSrcFile, 1, 1)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mirror/index.yaml", r.URL.Path, "request path")
+		usr, pass, ok := r.BasicAuth()
+		require.True(t, ok, "mirror request should be authenticated")
+		require.Equal(t, "mirroruser:mirrorpass", usr+":"+pass, "mirror credentials")
+		atomic.AddInt32(&requests, 1)
+		http.ServeFile(w, r, idxSrcFile)
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	t.Setenv("KHELM_REPO_"+hostEnvName(srvURL.Host)+"_USERNAME", "mirroruser")
+	t.Setenv("KHELM_REPO_"+hostEnvName(srvURL.Host)+"_PASSWORD", "mirrorpass")
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(tmpDir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(tmpDir, "cache")
+	trust := true
+	repoURL := "https://charts.example.org/stable"
+	opts := repositoryOptions{
+		trustAnyRepo: &trust,
+		creds:        &repositoryCredentials{},
+		mirrors:      Mirrors{{Prefix: "https://charts.example.org/stable/", Replacement: srv.URL + "/mirror/"}},
+	}
+	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, opts, settings, getter.All(settings))
+	require.NoError(t, err, "reposForURLs()")
+	err = repos.UpdateIndex(context.Background(), []string{repoURL})
+	require.NoError(t, err, "UpdateIndex()")
+	require.Equal(t, int32(1), requests, "mirror requests")
+}
+
+// TestRepositoryIndexUpdateGetter tests the index update of a repository that is downloaded using a getter
+// which cannot send conditional requests.
+func TestRepositoryIndexUpdateGetter(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-index-getter-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	idxSrcFile := filepath.Join(tmpDir, "index.yaml")
+	writeFakeIndexFile(t, idxSrcFile, 1, 1)
+	g := &fakeIndexGetter{file: idxSrcFile}
+	getters := getter.Providers{{Schemes: []string{"fake"}, New: func(...getter.Option) (getter.Getter, error) { return g, nil }}}
+	repoURL := "fake://charts.example.org"
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(tmpDir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(tmpDir, "cache")
+	trust := true
+	newRepos := func(maxAge time.Duration) repositoryConfig {
+		opts := repositoryOptions{trustAnyRepo: &trust, creds: &repositoryCredentials{}, indexMaxAge: maxAge}
+		repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, opts, settings, getters)
+		require.NoError(t, err, "reposForURLs()")
+		return repos
+	}
+	ctx := context.Background()
+
+	repos := newRepos(0)
+	err = repos.UpdateIndex(ctx, []string{repoURL})
+	require.NoError(t, err, "initial UpdateIndex()")
+	require.Equal(t, int32(1), g.requests, "requests after initial update")
+	entry, err := repos.Get(repoURL)
+	require.NoError(t, err)
+	idxFile := indexFile(entry, settings.RepositoryCache)
+	parsedFile := parsedIndexCacheFile(idxFile)
+	parsedInfo, err := os.Stat(parsedFile)
+	require.NoError(t, err, "parsed index should be cached after download")
+	past := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(idxFile, past, past)
+	require.NoError(t, err)
+
+	err = newRepos(0).UpdateIndex(ctx, []string{repoURL})
+	require.NoError(t, err, "UpdateIndex() of unchanged index")
+	require.Equal(t, int32(2), g.requests, "requests after unchanged update")
+	require.True(t, isFileFresh(idxFile, time.Hour), "unchanged index file should be marked as revalidated")
+	fi, err := os.Stat(parsedFile)
+	require.NoError(t, err)
+	require.Equal(t, parsedInfo.ModTime(), fi.ModTime(), "parsed index cache of unchanged index should be kept")
+
+	err = newRepos(time.Hour).UpdateIndex(ctx, []string{repoURL})
+	require.NoError(t, err, "UpdateIndex() within max age")
+	require.Equal(t, int32(2), g.requests, "requests within max age")
+
+	repos = newRepos(time.Hour)
+	err = repos.RefreshIndex(ctx, nil)
+	require.NoError(t, err, "RefreshIndex() without repositories")
+	require.Equal(t, int32(2), g.requests, "requests after refreshing no repository")
+	writeFakeIndexFile(t, idxSrcFile, 1, 2)
+	err = repos.RefreshIndex(ctx, []string{repoURL})
+	require.NoError(t, err, "RefreshIndex()")
+	require.Equal(t, int32(3), g.requests, "requests after refresh")
+	cv, err := repos.ResolveChartVersion(ctx, "chart-0", "1.0.1", repoURL)
+	require.NoError(t, err, "ResolveChartVersion() of changed index")
+	require.Equal(t, "1.0.1", cv.Version, "resolved version")
+}
+
+type fakeIndexGetter struct {
+	file     string
+	requests int32
+}
+
+func (g *fakeIndexGetter) Get(u string, _ ...getter.Option) (*bytes.Buffer, error) {
+	atomic.AddInt32(&g.requests, 1)
+	b, err := os.ReadFile(g.file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+func TestLoadCachedIndexFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-index-cache-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	idxFile := filepath.Join(tmpDir, "index.yaml")
+	writeFakeIndexFile(t, idxFile, 2, 3)
+
+	for i := 0; i < 2; i++ {
+		idx, err := loadCachedIndexFile(idxFile)
+		require.NoError(t, err, "loadCachedIndexFile()")
+		cv, err := idx.Get("chart-1", "1.0.2")
+		require.NoError(t, err, "idx.Get()")
+		require.Equal(t, []string{"https://charts.example.org/chart-1-1.0.2.tgz"}, cv.URLs, "urls")
+		cv, err = idx.Get("chart-1", "")
+		require.NoError(t, err, "idx.Get(latest)")
+		require.Equal(t, "1.0.2", cv.Version, "latest version")
+		_, err = os.Stat(parsedIndexCacheFile(idxFile))
+		require.NoError(t, err, "parsed index cache file should exist")
+	}
+
+	writeFakeIndexFile(t, idxFile, 2, 4)
+	idx, err := loadCachedIndexFile(idxFile)
+	require.NoError(t, err, "loadCachedIndexFile() after index changed")
+	_, err = idx.Get("chart-1", "1.0.3")
+	require.NoError(t, err, "changed index should be loaded")
+
+	_, err = loadCachedIndexFile(filepath.Join(tmpDir, "nonexisting.yaml"))
+	require.Error(t, err)
+	require.True(t, os.IsNotExist(errors.Cause(err)), "IsNotExist(%s)", err)
+}
+
+func BenchmarkLoadIndexFile(b *testing.B) {
+	tmpDir, err := os.MkdirTemp("", "khelm-bench-index-")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+	idxFile := filepath.Join(tmpDir, "index.yaml")
+	writeFakeIndexFile(b, idxFile, 200, 50)
+
+	b.Run("yaml", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := repo.LoadIndexFile(idxFile)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		_, err := loadCachedIndexFile(idxFile)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := loadCachedIndexFile(idxFile)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func writeFakeIndexFile(t testing.TB, file string, charts, versions int) {
+	idx := repo.NewIndexFile()
+	for c := 0; c < charts; c++ {
+		for v := 0; v < versions; v++ {
+			meta := &chart.Metadata{
+				APIVersion:  chart.APIVersionV2,
+				Name:        fmt.Sprintf("chart-%d", c),
+				Version:     fmt.Sprintf("1.0.%d", v),
+				AppVersion:  fmt.Sprintf("2.%d.0", v),
+				Description: "A fake chart to test repository index loading",
+				Keywords:    []string{"fake", "test"},
+				Maintainers: []*chart.Maintainer{{Name: "Fake Maintainer", Email: "fake@example.org"}},
+			}
+			file := fmt.Sprintf("%s-%s.tgz", meta.Name, meta.Version)
+			err := idx.MustAdd(meta, file, "https://charts.example.org", "sha256:0000000000000000")
+			require.NoError(t, err)
+		}
+	}
+	err := idx.WriteFile(file, 0644)
+	require.NoError(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Masterminds/semver/v3"
@@ -22,8 +23,20 @@ import (
 
 // loadChart loads chart from local or remote location
 func (h *Helm) loadChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
+	chartRequested, _, err := h.locateAndLoadChart(ctx, cfg)
+	return chartRequested, err
+}
+
+// locateAndLoadChart loads chart from local or remote location and returns it along with the path it was loaded from
+func (h *Helm) locateAndLoadChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, string, error) {
 	if cfg.Chart == "" {
-		return nil, errors.New("no chart specified")
+		return nil, "", errors.New("no chart specified")
+	}
+	if cfg.RegistryConfig != "" {
+		cfg.RegistryConfig = absPath(cfg.RegistryConfig, cfg.BaseDir)
+	}
+	if cfg.CredentialsFile != "" {
+		cfg.CredentialsFile = absPath(cfg.CredentialsFile, cfg.BaseDir)
 	}
 	_, err := os.Stat(absPath(cfg.Chart, cfg.BaseDir))
 	fileExists := err == nil
@@ -36,7 +49,7 @@ func (h *Helm) loadChart(ctx context.Context, cfg *config.ChartConfig) (*chart.C
 			cfg.Repository = "@" + l[0]
 			cfg.Chart = l[1]
 		} else {
-			return nil, errors.Errorf("chart directory %q not found and no repository specified", cfg.Chart)
+			return nil, "", errors.Errorf("chart directory %q not found and no repository specified", cfg.Chart)
 		}
 	} else if registry.IsOCI(cfg.Repository) {
 		cfg.Chart = fmt.Sprintf("%s/%s", cfg.Repository, cfg.Chart)
@@ -46,87 +59,124 @@ func (h *Helm) loadChart(ctx context.Context, cfg *config.ChartConfig) (*chart.C
 	return h.loadRemoteChart(ctx, cfg)
 }
 
-func (h *Helm) loadOCIChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
-	chartPath, err := locateChart(ctx, &cfg.LoaderConfig, nil, &h.Settings, h.Getters)
+func (h *Helm) loadOCIChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, string, error) {
+	if err := h.TrustPolicy.chartRules().checkOCI(cfg.Chart); err != nil {
+		return nil, "", err
+	}
+	creds, err := loadRepositoryCredentials(cfg.CredentialsFile)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return loader.Load(chartPath)
+	chartPath, err := locateChart(ctx, &cfg.LoaderConfig, nil, &h.Settings, h.loaderGetters(creds), h.Mirrors)
+	if err != nil {
+		return nil, "", err
+	}
+	chartRequested, err := loader.Load(chartPath)
+	return chartRequested, chartPath, err
 }
 
-func (h *Helm) loadRemoteChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
+func (h *Helm) loadRemoteChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, string, error) {
 	repoURLs := map[string]struct{}{cfg.Repository: {}}
-	repos, err := reposForURLs(repoURLs, h.TrustAnyRepository, &h.Settings, h.Getters)
+	opts, err := h.repositoryOptions(&cfg.LoaderConfig, h.TrustPolicy.chartRules())
+	if err != nil {
+		return nil, "", err
+	}
+	repos, err := reposForURLs(repoURLs, opts, &h.Settings, h.loaderGetters(opts.creds))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	isRange, err := isVersionRange(cfg.Version)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if isRange {
-		if err = repos.UpdateIndex(ctx); err != nil {
-			return nil, err
+		if err = repos.UpdateIndex(ctx, []string{cfg.Repository}); err != nil {
+			return nil, "", err
 		}
 	}
-	chartPath, err := locateChart(ctx, &cfg.LoaderConfig, repos, &h.Settings, h.Getters)
+	chartPath, err := locateChart(ctx, &cfg.LoaderConfig, repos, &h.Settings, h.loaderGetters(opts.creds), h.Mirrors)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return loader.Load(chartPath)
+	chartRequested, err := loader.Load(chartPath)
+	return chartRequested, chartPath, err
 }
 
-func (h *Helm) buildAndLoadLocalChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, error) {
+func (h *Helm) buildAndLoadLocalChart(ctx context.Context, cfg *config.ChartConfig) (*chart.Chart, string, error) {
 	chartPath := absPath(cfg.Chart, cfg.BaseDir)
 	chartRequested, err := loader.Load(chartPath)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, "", errors.WithStack(err)
+	}
+	if fi, err := os.Stat(chartPath); err == nil && !fi.IsDir() {
+		// A chart archive contains its dependencies already
+		if cfg.Verify {
+			if _, err = downloader.VerifyChart(chartPath, cfg.Keyring); err != nil {
+				return nil, "", err
+			}
+		}
+		return chartRequested, chartPath, nil
 	}
 
 	localCharts := make([]localChart, 0, 1)
 	dependencies := make([]*chart.Dependency, 0)
-	needsRepoIndexUpdate, err := collectCharts(chartRequested, chartPath, cfg, &localCharts, &dependencies, 0)
+	outdatedRepos := map[string]struct{}{}
+	err = collectCharts(chartRequested, chartPath, cfg, &localCharts, &dependencies, outdatedRepos, 0)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	for _, ch := range localCharts {
+		for _, dep := range ch.Chart.Metadata.Dependencies {
+			if registry.IsOCI(dep.Repository) {
+				if err = h.TrustPolicy.dependencyRules().checkOCI(dep.Repository + "/" + dep.Name); err != nil {
+					return nil, "", err
+				}
+			}
+		}
 	}
 
 	// Create (temporary) repository configuration that includes all dependencies
-	repos, err := reposForDependencies(dependencies, h.TrustAnyRepository, &h.Settings, h.Getters)
+	opts, err := h.repositoryOptions(&cfg.LoaderConfig, h.TrustPolicy.dependencyRules())
 	if err != nil {
-		return nil, errors.Wrap(err, "init temp repositories.yaml")
+		return nil, "", err
+	}
+	repos, err := reposForDependencies(dependencies, opts, &h.Settings, h.loaderGetters(opts.creds))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "init temp repositories.yaml")
 	}
 	repos.RequireTempHelmHome(len(localCharts) > 1)
 	repos, err = repos.Apply()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer repos.Close()
 	settings := h.Settings
 	settings.RepositoryConfig = repos.FilePath()
 
 	// Download/update repo indices
-	if needsRepoIndexUpdate {
-		err = repos.UpdateIndex(ctx)
-	} else {
-		err = repos.DownloadIndexFilesIfNotExist(ctx)
+	err = repos.UpdateIndex(ctx, sortedKeys(outdatedRepos))
+	if err != nil {
+		return nil, "", err
 	}
+	err = repos.DownloadIndexFilesIfNotExist(ctx)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// Build local charts recursively
-	needsReload, err := buildLocalCharts(ctx, localCharts, &cfg.LoaderConfig, repos, &settings, h.Getters)
+	needsReload, err := buildLocalCharts(ctx, localCharts, &cfg.LoaderConfig, repos, &settings, h.loaderGetters(opts.creds), h.Mirrors)
 	if err != nil {
-		return nil, errors.Wrap(err, "build/fetch dependencies")
+		return nil, "", errors.Wrap(err, "build/fetch dependencies")
 	}
 	// Reload the chart with the updated Chart.lock file
 	if needsReload {
 		chartRequested, err = loader.Load(chartPath)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed reloading chart %s after dependency download", cfg.Chart)
+			return nil, "", errors.Wrapf(err, "failed reloading chart %s after dependency download", cfg.Chart)
 		}
 	}
-	return chartRequested, nil
+	return chartRequested, chartPath, nil
 }
 
 func isVersionRange(version string) (bool, error) {
@@ -150,13 +200,15 @@ type localChart struct {
 	LocalDependencies bool
 }
 
-func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.ChartConfig, localCharts *[]localChart, deps *[]*chart.Dependency, depth int) (needsRepoIndexUpdate bool, err error) {
+// collectCharts collects the local charts and their remote dependencies recursively.
+// The repositories of remote dependencies that are not locked are added to outdatedRepos since their index needs to be updated.
+func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.ChartConfig, localCharts *[]localChart, deps *[]*chart.Dependency, outdatedRepos map[string]struct{}, depth int) error {
 	if depth > 20 {
-		return false, errors.New("collect local charts recursively: max depth of 20 reached - cyclic dependency?")
+		return errors.New("collect local charts recursively: max depth of 20 reached - cyclic dependency?")
 	}
 	meta := chartRequested.Metadata
 	if meta == nil {
-		return false, errors.Errorf("chart %s has no metadata", chartPath)
+		return errors.Errorf("chart %s has no metadata", chartPath)
 	}
 	name := fmt.Sprintf("%s %s", meta.Name, meta.Version)
 	reqDeps := chartRequested.Metadata.Dependencies
@@ -168,20 +220,17 @@ func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.Ch
 			depChartPath = absPath(depChartPath, chartPath)
 			depChart, err := loader.LoadDir(depChartPath)
 			if err != nil {
-				return false, errors.Wrapf(err, "load chart %s dependency %s from dir %s", name, dep.Name, depChartPath)
+				return errors.Wrapf(err, "load chart %s dependency %s from dir %s", name, dep.Name, depChartPath)
 			}
-			needsUpdate, err := collectCharts(depChart, depChartPath, cfg, localCharts, deps, depth+1)
+			err = collectCharts(depChart, depChartPath, cfg, localCharts, deps, outdatedRepos, depth+1)
 			if err != nil {
-				return false, errors.WithStack(err)
-			}
-			if needsUpdate {
-				needsRepoIndexUpdate = true
+				return errors.WithStack(err)
 			}
 		} else if strings.HasPrefix(dep.Repository, "https://") || strings.HasPrefix(dep.Repository, "http://") {
 			*deps = append(*deps, dep)
 			if chartRequested.Lock == nil {
 				// Update repo index when remote dependencies present but no lock file
-				needsRepoIndexUpdate = true
+				outdatedRepos[dep.Repository] = struct{}{}
 			}
 		}
 	}
@@ -190,10 +239,10 @@ func collectCharts(chartRequested *chart.Chart, chartPath string, cfg *config.Ch
 		Path:              chartPath,
 		LocalDependencies: hasLocalDependencies,
 	})
-	return needsRepoIndexUpdate, nil
+	return nil
 }
 
-func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) (needsReload bool, err error) {
+func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers, mirrors Mirrors) (needsReload bool, err error) {
 	for _, ch := range localCharts {
 		if err = action.CheckDependencies(ch.Chart, ch.Chart.Metadata.Dependencies); err != nil || ch.LocalDependencies {
 			needsReload = true
@@ -204,7 +253,7 @@ func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config
 			name := fmt.Sprintf("%s %s", meta.Name, meta.Version)
 			log.Printf("Building/fetching chart %s dependencies", name)
 
-			if err = buildChartDependencies(ctx, ch.Chart, ch.Path, cfg, repos, settings, getters); err != nil {
+			if err = buildChartDependencies(ctx, ch.Chart, ch.Path, cfg, repos, settings, getters, mirrors); err != nil {
 				depErrSuffix := ". Please update the dependencies"
 				if strings.HasSuffix(err.Error(), depErrSuffix) {
 					err = errors.Wrapf(err, "build chart %s", name)
@@ -220,7 +269,7 @@ func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config
 							return false, errors.WithStack(err)
 						}
 					}
-					err = buildChartDependencies(ctx, ch.Chart, ch.Path, cfg, repos, settings, getters)
+					err = buildChartDependencies(ctx, ch.Chart, ch.Path, cfg, repos, settings, getters, mirrors)
 					if err != nil {
 						return false, errors.Wrapf(err, "build chart %s", name)
 					}
@@ -233,12 +282,10 @@ func buildLocalCharts(ctx context.Context, localCharts []localChart, cfg *config
 	return needsReload, nil
 }
 
-func buildChartDependencies(ctx context.Context, chartRequested *chart.Chart, chartPath string, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) error {
-	registryClient, err := registry.NewClient(
-		registry.ClientOptEnableCache(true),
-	)
+func buildChartDependencies(ctx context.Context, chartRequested *chart.Chart, chartPath string, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers, mirrors Mirrors) error {
+	registryClient, err := newRegistryClient(cfg, settings, mirrors)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 	man := &downloader.Manager{
 		Out:              log.Writer(),
@@ -262,9 +309,45 @@ func buildChartDependencies(ctx context.Context, chartRequested *chart.Chart, ch
 	// Downloads dependencies - respecting requirements.lock if present
 	err = man.Build()
 	if err != nil && errors.Cause(err).Error() == "entry not found" {
-		if err = repos.UpdateIndex(ctx); err == nil {
+		// Refresh only the index files of the chart's own dependency repositories
+		if err = repos.RefreshIndex(ctx, remoteDependencyRepos(chartRequested)); err == nil {
 			err = man.Build()
 		}
 	}
 	return errors.WithStack(err)
 }
+
+// remoteDependencyRepos returns the URLs of the chart's (non-OCI) remote dependency repositories.
+func remoteDependencyRepos(chartRequested *chart.Chart) []string {
+	repoURLs := map[string]struct{}{}
+	for _, dep := range chartRequested.Metadata.Dependencies {
+		if strings.HasPrefix(dep.Repository, "https://") || strings.HasPrefix(dep.Repository, "http://") {
+			repoURLs[dep.Repository] = struct{}{}
+		}
+	}
+	return sortedKeys(repoURLs)
+}
+
+// repositoryOptions returns the options to access repositories using the given trust rules.
+func (h *Helm) repositoryOptions(cfg *config.LoaderConfig, trust trustRules) (repositoryOptions, error) {
+	creds, err := loadRepositoryCredentials(cfg.CredentialsFile)
+	if err != nil {
+		return repositoryOptions{}, err
+	}
+	return repositoryOptions{
+		trustAnyRepo: h.TrustAnyRepository,
+		trust:        trust,
+		creds:        creds,
+		mirrors:      h.Mirrors,
+		indexMaxAge:  h.IndexMaxAge,
+	}, nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
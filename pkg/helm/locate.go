@@ -21,7 +21,8 @@ import (
 // locateChart fetches the chart if not present in cache and returns its path.
 // (derived from https://github.com/helm/helm/blob/fc9b46067f8f24a90b52eba31e09b31e69011e93/pkg/action/install.go#L621 -
 // with efficient caching)
-func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers) (string, error) {
+// The chart is downloaded from its mirror if any is configured while the cache key is derived from the original URL.
+func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repositoryConfig, settings *cli.EnvSettings, getters getter.Providers, mirrors Mirrors) (string, error) {
 	name := strings.TrimSpace(cfg.Chart)
 	version := strings.TrimSpace(cfg.Version)
 	digest := "none"
@@ -92,10 +93,12 @@ func locateChart(ctx context.Context, cfg *config.LoaderConfig, repos repository
 		return cacheFile, nil
 	}
 
+	if mirrorURL := mirrors.Rewrite(chartURL); mirrorURL != chartURL {
+		log.Printf("Using mirror %s", mirrorURL)
+	}
 	if registry.IsOCI(name) {
-		registryClient, err := registry.NewClient(
-			registry.ClientOptEnableCache(true),
-		)
+		// The registry client sends the requests to the mirror while the getters rewrite the other URLs
+		registryClient, err := newRegistryClient(cfg, settings, mirrors)
 		if err != nil {
 			return "", err
 		}
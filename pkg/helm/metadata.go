@@ -0,0 +1,127 @@
+package helm
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// mapFieldSpec specifies a map field within resources of a kind.
+// The map is only created if the parent field exists.
+type mapFieldSpec struct {
+	Kind   string
+	Parent []string
+	Field  []string
+}
+
+var (
+	// podTemplateMetadataFields lists the pod template metadata fields of the well-known workload kinds
+	podTemplateMetadataFields = []mapFieldSpec{
+		{Kind: "Deployment", Parent: []string{"spec", "template"}, Field: []string{yaml.MetadataField}},
+		{Kind: "StatefulSet", Parent: []string{"spec", "template"}, Field: []string{yaml.MetadataField}},
+		{Kind: "DaemonSet", Parent: []string{"spec", "template"}, Field: []string{yaml.MetadataField}},
+		{Kind: "ReplicaSet", Parent: []string{"spec", "template"}, Field: []string{yaml.MetadataField}},
+		{Kind: "Job", Parent: []string{"spec", "template"}, Field: []string{yaml.MetadataField}},
+		{Kind: "CronJob", Parent: []string{"spec", "jobTemplate"}, Field: []string{yaml.MetadataField}},
+		{Kind: "CronJob", Parent: []string{"spec", "jobTemplate", "spec", "template"}, Field: []string{yaml.MetadataField}},
+	}
+	// selectorFields lists the label selector fields of the well-known kinds
+	selectorFields = []mapFieldSpec{
+		{Kind: "Deployment", Parent: []string{"spec", "selector"}, Field: []string{"matchLabels"}},
+		{Kind: "StatefulSet", Parent: []string{"spec", "selector"}, Field: []string{"matchLabels"}},
+		{Kind: "DaemonSet", Parent: []string{"spec", "selector"}, Field: []string{"matchLabels"}},
+		{Kind: "ReplicaSet", Parent: []string{"spec", "selector"}, Field: []string{"matchLabels"}},
+		{Kind: "PodDisruptionBudget", Parent: []string{"spec", "selector"}, Field: []string{"matchLabels"}},
+		{Kind: "Service", Parent: []string{"spec", "selector"}},
+	}
+)
+
+// applyCommonMetadata adds the common labels and annotations to the given resources.
+func (t *manifestTransformer) applyCommonMetadata(resources []*yaml.RNode) error {
+	if len(t.CommonLabels) == 0 && len(t.CommonAnnotations) == 0 {
+		return nil
+	}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return err
+		}
+		err = addMapEntries(o, []string{yaml.MetadataField, yaml.LabelsField}, t.CommonLabels)
+		if err != nil {
+			return errors.Wrapf(err, "add common labels to %s %s", meta.Kind, meta.Name)
+		}
+		err = addMapEntries(o, []string{yaml.MetadataField, yaml.AnnotationsField}, t.CommonAnnotations)
+		if err != nil {
+			return errors.Wrapf(err, "add common annotations to %s %s", meta.Kind, meta.Name)
+		}
+		if t.CommonMetadataInPodTemplates || t.CommonLabelsInSelectors {
+			for _, f := range podTemplateMetadataFields {
+				if f.Kind != meta.Kind {
+					continue
+				}
+				err = addMapEntriesIfParentExists(o, f.Parent, append(f.Field, yaml.LabelsField), t.CommonLabels)
+				if err != nil {
+					return errors.Wrapf(err, "add common labels to pod template of %s %s", meta.Kind, meta.Name)
+				}
+				if !t.CommonMetadataInPodTemplates {
+					continue
+				}
+				err = addMapEntriesIfParentExists(o, f.Parent, append(f.Field, yaml.AnnotationsField), t.CommonAnnotations)
+				if err != nil {
+					return errors.Wrapf(err, "add common annotations to pod template of %s %s", meta.Kind, meta.Name)
+				}
+			}
+		}
+		if t.CommonLabelsInSelectors {
+			for _, f := range selectorFields {
+				if f.Kind != meta.Kind {
+					continue
+				}
+				err = addMapEntriesIfParentExists(o, f.Parent, f.Field, t.CommonLabels)
+				if err != nil {
+					return errors.Wrapf(err, "add common labels to selector of %s %s", meta.Kind, meta.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addMapEntriesIfParentExists adds the entries to the map at the given path relative to the parent if the parent exists.
+func addMapEntriesIfParentExists(o *yaml.RNode, parentPath, path []string, entries map[string]string) error {
+	parent, err := o.Pipe(yaml.Lookup(parentPath...))
+	if err != nil || parent == nil || parent.YNode().Kind != yaml.MappingNode {
+		return err
+	}
+	return addMapEntries(parent, path, entries)
+}
+
+// addMapEntries adds the entries to the map at the given path, creating it if it doesn't exist.
+func addMapEntries(o *yaml.RNode, path []string, entries map[string]string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if len(path) > 0 {
+		// Remove the field if empty since LookupCreate() doesn't create the MappingNode if it exists but is empty (#13).
+		err := o.PipeE(yaml.LookupCreate(yaml.MappingNode, path[:len(path)-1]...), yaml.FieldClearer{Name: path[len(path)-1], IfEmpty: true})
+		if err != nil {
+			return err
+		}
+	}
+	m, err := o.Pipe(yaml.LookupCreate(yaml.MappingNode, path...))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = m.PipeE(yaml.FieldSetter{Name: k, Value: yaml.NewStringRNode(entries[k])}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
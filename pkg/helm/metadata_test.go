@@ -0,0 +1,112 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/stretchr/testify/require"
+)
+
+const commonMetadataManifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp
+  labels: {}
+spec:
+  selector:
+    matchLabels:
+      app: myapp
+  template:
+    metadata:
+      labels:
+        app: myapp
+    spec:
+      containers:
+      - name: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: myservice
+  annotations:
+    other: annotation
+spec:
+  selector:
+    app: myapp
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: external
+spec:
+  type: ExternalName
+  externalName: example.org
+`
+
+func TestCommonMetadata(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		podTemplates bool
+		selectors    bool
+		contained    []string
+		notContained []string
+	}{
+		{
+			"metadata only",
+			false, false,
+			[]string{
+				"  name: myapp\n  labels:\n    team: a\n  annotations:\n    owner: a@example.org\n",
+				"  annotations:\n    other: annotation\n    owner: a@example.org\n  labels:\n    team: a\n",
+				"  name: external\n  labels:\n    team: a\n",
+				"  selector:\n    matchLabels:\n      app: myapp\n  template:\n    metadata:\n      labels:\n        app: myapp\n    spec:",
+				"  selector:\n    app: myapp\n",
+			},
+			nil,
+		},
+		{
+			"pod templates",
+			true, false,
+			[]string{
+				"  selector:\n    matchLabels:\n      app: myapp\n  template:\n    metadata:\n      labels:\n        app: myapp\n        team: a\n      annotations:\n        owner: a@example.org\n",
+				"  selector:\n    app: myapp\n",
+			},
+			nil,
+		},
+		{
+			"selectors",
+			false, true,
+			[]string{
+				"  selector:\n    matchLabels:\n      app: myapp\n      team: a\n  template:\n    metadata:\n      labels:\n        app: myapp\n        team: a\n    spec:",
+				"  selector:\n    app: myapp\n    team: a\n",
+				"  type: ExternalName\n  externalName: example.org\n",
+			},
+			[]string{"      annotations:\n        owner:"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testee := manifestTransformer{
+				CommonLabels:                 map[string]string{"team": "a"},
+				CommonAnnotations:            map[string]string{"owner": "a@example.org"},
+				CommonMetadataInPodTemplates: c.podTemplates,
+				CommonLabelsInSelectors:      c.selectors,
+				Includes:                     matcher.Any(),
+				Excludes:                     matcher.FromResourceSelectors(nil),
+			}
+			r, err := testee.TransformManifest(strings.NewReader(commonMetadataManifest))
+			require.NoError(t, err)
+			out := ""
+			for _, o := range r {
+				out += o.MustString() + "---\n"
+			}
+			for _, s := range c.contained {
+				require.Contains(t, out, s)
+			}
+			for _, s := range c.notContained {
+				require.NotContains(t, out, s)
+			}
+			require.NotContains(t, out, "selector:\n    team")
+		})
+	}
+}
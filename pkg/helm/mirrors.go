@@ -0,0 +1,221 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"sigs.k8s.io/yaml"
+)
+
+// Mirror specifies a replacement for repository, chart and OCI registry URLs that start with the given prefix.
+type Mirror struct {
+	Prefix      string `json:"prefix"`
+	Replacement string `json:"replacement"`
+}
+
+// Mirrors rewrites URLs using the mirror with the longest matching prefix.
+type Mirrors []Mirror
+
+// ParseMirrors parses a comma-separated list of prefix=replacement pairs.
+func ParseMirrors(s string) (Mirrors, error) {
+	var m Mirrors
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid mirror %q, expected prefix=replacement", pair)
+		}
+		m = append(m, Mirror{Prefix: strings.TrimSpace(kv[0]), Replacement: strings.TrimSpace(kv[1])})
+	}
+	return m, m.validate()
+}
+
+// LoadMirrors loads the mirrors from a YAML file that contains a list of prefix and replacement pairs.
+func LoadMirrors(file string) (Mirrors, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "load mirrors")
+	}
+	var m Mirrors
+	if err = yaml.UnmarshalStrict(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "load mirrors from %s", file)
+	}
+	return m, errors.Wrapf(m.validate(), "load mirrors from %s", file)
+}
+
+func (m Mirrors) validate() error {
+	for _, mirror := range m {
+		if mirror.Prefix == "" || mirror.Replacement == "" {
+			return errors.Errorf("invalid mirror %q=%q: prefix and replacement must not be empty", mirror.Prefix, mirror.Replacement)
+		}
+	}
+	return nil
+}
+
+// Rewrite replaces the URL's prefix with the replacement of the mirror with the longest matching prefix.
+// A prefix only matches at a path, tag or digest boundary.
+// URLs that have been rewritten already are returned as they are.
+func (m Mirrors) Rewrite(u string) string {
+	if mirror := m.find(u); mirror != nil {
+		return mirror.rewrite(u)
+	}
+	return u
+}
+
+// find returns the mirror with the longest prefix that matches the URL or nil if the URL is not mirrored.
+func (m Mirrors) find(u string) *Mirror {
+	var match *Mirror
+	for i, mirror := range m {
+		if strings.HasPrefix(u, mirror.Replacement) {
+			return nil
+		}
+		if !matchesPrefix(u, strings.TrimSuffix(mirror.Prefix, "/")) {
+			continue
+		}
+		if match == nil || len(mirror.Prefix) > len(match.Prefix) {
+			match = &m[i]
+		}
+	}
+	return match
+}
+
+func (m *Mirror) rewrite(u string) string {
+	return strings.TrimSuffix(m.Replacement, "/") + u[len(strings.TrimSuffix(m.Prefix, "/")):]
+}
+
+func matchesPrefix(u, prefix string) bool {
+	if !strings.HasPrefix(u, prefix) {
+		return false
+	}
+	return len(u) == len(prefix) || strings.ContainsRune("/:@?", rune(u[len(prefix)]))
+}
+
+// Getters returns getter providers that download from the mirrors.
+func (m Mirrors) Getters(providers getter.Providers, creds *repositoryCredentials) getter.Providers {
+	if len(m) == 0 {
+		return providers
+	}
+	mirrored := make(getter.Providers, len(providers))
+	for i, p := range providers {
+		newGetter := p.New
+		mirrored[i] = getter.Provider{
+			Schemes: p.Schemes,
+			New: func(options ...getter.Option) (getter.Getter, error) {
+				g, err := newGetter(options...)
+				if err != nil {
+					return nil, err
+				}
+				return &mirrorGetter{g, m, creds}, nil
+			},
+		}
+	}
+	return mirrored
+}
+
+type mirrorGetter struct {
+	getter.Getter
+	mirrors Mirrors
+	creds   *repositoryCredentials
+}
+
+// Get downloads the given URL from its mirror.
+// The credentials configured for the original URL are replaced with those configured for the mirror.
+func (g *mirrorGetter) Get(u string, options ...getter.Option) (*bytes.Buffer, error) {
+	mirror := g.mirrors.find(u)
+	if mirror == nil {
+		return g.Getter.Get(u, options...)
+	}
+	entry := &repo.Entry{URL: mirror.Replacement}
+	g.creds.apply(entry)
+	options = append(options,
+		getter.WithURL(mirror.Replacement),
+		getter.WithBasicAuth(entry.Username, entry.Password),
+		getter.WithPassCredentialsAll(entry.PassCredentialsAll),
+		getter.WithTLSClientConfig(entry.CertFile, entry.KeyFile, entry.CAFile),
+		getter.WithInsecureSkipVerifyTLS(entry.InsecureSkipTLSverify),
+	)
+	return g.Getter.Get(mirror.rewrite(u), options...)
+}
+
+const registryAPIPrefix = "/v2/"
+
+// registryTransport redirects the OCI registry API requests of mirrored repositories to their mirrors.
+// This way also the tags of chart dependencies with a version range are listed using the mirror.
+type registryTransport struct {
+	http.RoundTripper
+	mirrors Mirrors
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u := t.mirrors.registryURL(req.URL); u != nil {
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = u.Host
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// registryURL returns the mirror URL of the given registry API URL or nil if the registry repository is not mirrored.
+func (m Mirrors) registryURL(u *url.URL) *url.URL {
+	repoPath, ok := strings.CutPrefix(u.Path, registryAPIPrefix)
+	if !ok {
+		return nil
+	}
+	ref := fmt.Sprintf("%s://%s", registry.OCIScheme, u.Host)
+	if repoPath != "" {
+		ref = fmt.Sprintf("%s/%s", ref, repoPath)
+	}
+	mirror := m.find(ref)
+	if mirror == nil {
+		return nil
+	}
+	mirrorURL, err := url.Parse(mirror.rewrite(ref))
+	if err != nil {
+		return nil
+	}
+	r := *u
+	r.Host = mirrorURL.Host
+	r.RawPath = ""
+	if repoPath != "" {
+		r.Path = registryAPIPrefix + strings.TrimPrefix(mirrorURL.Path, "/")
+	}
+	return &r
+}
+
+// registryHost returns the host that the request with the given context and registry host is sent to.
+// The repository is derived from the auth scopes that are added to the request context by oras.
+func (m Mirrors) registryHost(ctx context.Context, host string) string {
+	repoPath := ""
+	for _, scope := range auth.GetAllScopesForHost(ctx, host) {
+		if parts := strings.SplitN(scope, ":", 3); len(parts) == 3 && parts[0] == "repository" {
+			repoPath = parts[1]
+			break
+		}
+	}
+	if u := m.registryURL(&url.URL{Host: host, Path: registryAPIPrefix + repoPath}); u != nil {
+		return u.Host
+	}
+	return host
+}
+
+// hasRegistries returns true if OCI registries are mirrored.
+func (m Mirrors) hasRegistries() bool {
+	for _, mirror := range m {
+		if registry.IsOCI(mirror.Prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestMirrorsRewrite(t *testing.T) {
+	mirrors, err := ParseMirrors("https://charts.example.org=https://mirror.example.org/charts, https://charts.example.org/special/=https://special.example.org,oci://ghcr.io=oci://mirror.example.org/ghcr")
+	require.NoError(t, err)
+	for _, c := range []struct {
+		input    string
+		expected string
+	}{
+		{"https://charts.example.org", "https://mirror.example.org/charts"},
+		{"https://charts.example.org/index.yaml", "https://mirror.example.org/charts/index.yaml"},
+		{"https://charts.example.org/special/chart-1.0.0.tgz", "https://special.example.org/chart-1.0.0.tgz"},
+		{"https://charts.example.org.other.com/index.yaml", "https://charts.example.org.other.com/index.yaml"},
+		{"https://mirror.example.org/charts/index.yaml", "https://mirror.example.org/charts/index.yaml"},
+		{"oci://ghcr.io/org/chart:1.0.0", "oci://mirror.example.org/ghcr/org/chart:1.0.0"},
+		{"oci://docker.io/org/chart", "oci://docker.io/org/chart"},
+	} {
+		require.Equal(t, c.expected, mirrors.Rewrite(c.input), "Rewrite(%q)", c.input)
+	}
+	for _, invalid := range []string{"https://charts.example.org", "=https://mirror.example.org", "https://charts.example.org="} {
+		_, err = ParseMirrors(invalid)
+		require.Error(t, err, "ParseMirrors(%q)", invalid)
+	}
+}
+
+func TestRenderMirror(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-mirror-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ch, err := loader.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	fakeChartTgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	origHelmHome := os.Getenv("HELM_HOME")
+	err = os.Setenv("HELM_HOME", tmpDir)
+	require.NoError(t, err)
+	defer os.Setenv("HELM_HOME", origHelmHome)
+
+	cfg := config.NewChartConfig()
+	cfg.Chart = "private-chart"
+	cfg.Name = "myrelease"
+	cfg.Version = fmt.Sprintf("0.0.%d", time.Now().Unix())
+	cfg.BaseDir = rootDir
+	cfg.Repository = "https://charts.example.invalid"
+	entry := &repo.Entry{Name: "myprivaterepo", URL: cfg.Repository, Username: "mirroruser", Password: "mirrorpassword"}
+	leaked := false
+	chartServer := &fakePrivateChartServerHandler{entry, &cfg.LoaderConfig, fakeChartTgz, "0000000000000000"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if usr, _, _ := r.BasicAuth(); usr == "origuser" {
+			leaked = true
+		}
+		chartServer.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	t.Setenv("KHELM_REPO_CHARTS_EXAMPLE_INVALID_USERNAME", "origuser")
+	t.Setenv("KHELM_REPO_CHARTS_EXAMPLE_INVALID_PASSWORD", "origpassword")
+	mirrorHost := hostEnvName(strings.TrimPrefix(srv.URL, "http://"))
+	t.Setenv(fmt.Sprintf("KHELM_REPO_%s_USERNAME", mirrorHost), entry.Username)
+	t.Setenv(fmt.Sprintf("KHELM_REPO_%s_PASSWORD", mirrorHost), entry.Password)
+
+	h := NewHelm()
+	trust := true
+	h.TrustAnyRepository = &trust
+	h.Mirrors = Mirrors{{Prefix: cfg.Repository, Replacement: srv.URL}}
+	resources, err := h.Render(context.Background(), cfg)
+	require.NoError(t, err, "render chart from mirror")
+	require.NotEmpty(t, resources, "resources")
+	require.False(t, leaked, "credentials of the original repository should not be passed to the mirror")
+	_, err = os.Stat(filepath.Join(h.Settings.RepositoryCache, "khelm", "charts.example.invalid"))
+	require.NoError(t, err, "chart should be cached using the original URL")
+}
+
+func TestMirrorsRegistryURL(t *testing.T) {
+	mirrors, err := ParseMirrors("oci://ghcr.io=oci://mirror.example.org/ghcr,oci://quay.io/org=oci://mirror.example.org/quay-org,https://charts.example.org=https://mirror.example.org/charts")
+	require.NoError(t, err)
+	for _, c := range []struct {
+		input    string
+		expected string
+	}{
+		{"https://ghcr.io/v2/org/chart/tags/list", "https://mirror.example.org/v2/ghcr/org/chart/tags/list"},
+		{"https://ghcr.io/v2/org/chart/manifests/1.0.0", "https://mirror.example.org/v2/ghcr/org/chart/manifests/1.0.0"},
+		{"https://ghcr.io/v2/", "https://mirror.example.org/v2/"},
+		{"https://quay.io/v2/org/chart/tags/list", "https://mirror.example.org/v2/quay-org/chart/tags/list"},
+		{"https://quay.io/v2/other/chart/tags/list", ""},
+		{"https://mirror.example.org/v2/ghcr/org/chart/tags/list", ""},
+		{"https://charts.example.org/v2/org/chart/tags/list", ""},
+		{"https://ghcr.io/token", ""},
+	} {
+		u, err := url.Parse(c.input)
+		require.NoError(t, err)
+		actual := ""
+		if mirrorURL := mirrors.registryURL(u); mirrorURL != nil {
+			actual = mirrorURL.String()
+		}
+		require.Equal(t, c.expected, actual, "registryURL(%q)", c.input)
+	}
+
+	ctx := auth.AppendRepositoryScope(context.Background(), registry.Reference{Registry: "quay.io", Repository: "org/chart"}, auth.ActionPull)
+	require.Equal(t, "mirror.example.org", mirrors.registryHost(ctx, "quay.io"), "registryHost() of mirrored repository")
+	ctx = auth.AppendRepositoryScope(context.Background(), registry.Reference{Registry: "quay.io", Repository: "other/chart"}, auth.ActionPull)
+	require.Equal(t, "quay.io", mirrors.registryHost(ctx, "quay.io"), "registryHost() of other repository")
+	require.Equal(t, "mirror.example.org", mirrors.registryHost(context.Background(), "ghcr.io"), "registryHost() of mirrored registry")
+}
@@ -0,0 +1,164 @@
+package helm
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// nameReference specifies a field within resources of a kind that refers to another resource by name.
+// When Target is empty the referenced kind is read from the kind field next to the name field
+// and must be one of TargetKinds.
+// A namespace field next to the name field overrides the namespace of the referenced resource.
+type nameReference struct {
+	Kind        string
+	Path        string
+	Target      string
+	TargetKinds []string
+}
+
+// nameReferences lists the well-known name references, derived from kustomize's nameReference configuration.
+var nameReferences = func() []nameReference {
+	podSpecRefs := []nameReference{
+		{Path: "volumes/configMap/name", Target: "ConfigMap"},
+		{Path: "volumes/projected/sources/configMap/name", Target: "ConfigMap"},
+		{Path: "volumes/secret/secretName", Target: "Secret"},
+		{Path: "volumes/projected/sources/secret/name", Target: "Secret"},
+		{Path: "volumes/persistentVolumeClaim/claimName", Target: "PersistentVolumeClaim"},
+		{Path: "imagePullSecrets/name", Target: "Secret"},
+		{Path: "serviceAccountName", Target: "ServiceAccount"},
+		{Path: "serviceAccount", Target: "ServiceAccount"},
+		{Path: "priorityClassName", Target: "PriorityClass"},
+	}
+	for _, c := range []string{"containers", "initContainers"} {
+		podSpecRefs = append(podSpecRefs,
+			nameReference{Path: c + "/env/valueFrom/configMapKeyRef/name", Target: "ConfigMap"},
+			nameReference{Path: c + "/env/valueFrom/secretKeyRef/name", Target: "Secret"},
+			nameReference{Path: c + "/envFrom/configMapRef/name", Target: "ConfigMap"},
+			nameReference{Path: c + "/envFrom/secretRef/name", Target: "Secret"},
+		)
+	}
+	refs := []nameReference{
+		{Kind: "StatefulSet", Path: "spec/serviceName", Target: "Service"},
+		{Kind: "Ingress", Path: "spec/defaultBackend/service/name", Target: "Service"},
+		{Kind: "Ingress", Path: "spec/rules/http/paths/backend/service/name", Target: "Service"},
+		{Kind: "Ingress", Path: "spec/backend/serviceName", Target: "Service"},
+		{Kind: "Ingress", Path: "spec/rules/http/paths/backend/serviceName", Target: "Service"},
+		{Kind: "Ingress", Path: "spec/tls/secretName", Target: "Secret"},
+		{Kind: "ServiceAccount", Path: "secrets/name", Target: "Secret"},
+		{Kind: "ServiceAccount", Path: "imagePullSecrets/name", Target: "Secret"},
+		{Kind: "RoleBinding", Path: "roleRef/name", TargetKinds: []string{"Role", "ClusterRole"}},
+		{Kind: "RoleBinding", Path: "subjects/name", TargetKinds: []string{"ServiceAccount"}},
+		{Kind: "ClusterRoleBinding", Path: "roleRef/name", TargetKinds: []string{"ClusterRole"}},
+		{Kind: "ClusterRoleBinding", Path: "subjects/name", TargetKinds: []string{"ServiceAccount"}},
+		{Kind: "ValidatingWebhookConfiguration", Path: "webhooks/clientConfig/service/name", Target: "Service"},
+		{Kind: "MutatingWebhookConfiguration", Path: "webhooks/clientConfig/service/name", Target: "Service"},
+		{Kind: "APIService", Path: "spec/service/name", Target: "Service"},
+		{Kind: "CustomResourceDefinition", Path: "spec/conversion/webhook/clientConfig/service/name", Target: "Service"},
+		{Kind: "CustomResourceDefinition", Path: "spec/conversion/webhookClientConfig/service/name", Target: "Service"},
+		{Kind: "HorizontalPodAutoscaler", Path: "spec/scaleTargetRef/name", TargetKinds: []string{"Deployment", "StatefulSet", "ReplicaSet", "ReplicationController"}},
+		{Kind: "StatefulSet", Path: "spec/volumeClaimTemplates/spec/storageClassName", Target: "StorageClass"},
+		{Kind: "StatefulSet", Path: "spec/volumeClaimTemplates/spec/volumeName", Target: "PersistentVolume"},
+		{Kind: "PersistentVolumeClaim", Path: "spec/storageClassName", Target: "StorageClass"},
+		{Kind: "PersistentVolumeClaim", Path: "spec/volumeName", Target: "PersistentVolume"},
+		{Kind: "PersistentVolume", Path: "spec/storageClassName", Target: "StorageClass"},
+		{Kind: "PersistentVolume", Path: "spec/claimRef/name", Target: "PersistentVolumeClaim"},
+	}
+	for _, w := range podSpecFields {
+		for _, r := range podSpecRefs {
+			refs = append(refs, nameReference{Kind: w.Kind, Path: w.Path + "/" + r.Path, Target: r.Target})
+		}
+	}
+	return refs
+}()
+
+var (
+	// renameSkipKinds lists the kinds whose names are not prefixed/suffixed (as within kustomize)
+	renameSkipKinds = map[string]bool{"CustomResourceDefinition": true, "APIService": true, "Namespace": true}
+	// clusterScopedReferenceKinds lists the referenced kinds that are not namespaced
+	clusterScopedReferenceKinds = map[string]bool{"ClusterRole": true, "StorageClass": true, "PersistentVolume": true, "PriorityClass": true}
+)
+
+// renameResources adds the configured prefix and suffix to the resource names and updates the references to them.
+// The references that cannot be resolved within the given resources are returned.
+func (t *manifestTransformer) renameResources(resources []manifestResource) (unresolved []string, err error) {
+	if t.NamePrefix == "" && t.NameSuffix == "" {
+		return nil, nil
+	}
+	names := map[string]string{}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		key := nameKey(meta.Kind, effectiveNamespace(&meta, t.Namespace), meta.Name)
+		if renameSkipKinds[meta.Kind] || meta.Name == "" {
+			names[key] = meta.Name
+			continue
+		}
+		newName := t.NamePrefix + meta.Name + t.NameSuffix
+		names[key] = newName
+		if err = o.SetName(newName); err != nil {
+			return nil, errors.Wrapf(err, "rename %s %s", meta.Kind, meta.Name)
+		}
+	}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range nameReferences {
+			if ref.Kind != meta.Kind {
+				continue
+			}
+			err = visitFields(o.RNode, strings.Split(ref.Path, "/"), func(parent, field *yaml.RNode) error {
+				target := ref.Target
+				if target == "" {
+					target = stringField(parent, yaml.KindField)
+					if !slices.Contains(ref.TargetKinds, target) {
+						return nil
+					}
+				}
+				namespace := effectiveNamespace(&meta, t.Namespace)
+				if ns := stringField(parent, yaml.NamespaceField); ns != "" {
+					namespace = ns
+				}
+				if clusterScopedReferenceKinds[target] {
+					namespace = ""
+				}
+				name := field.YNode().Value
+				newName, found := names[nameKey(target, namespace, name)]
+				if !found {
+					unresolved = append(unresolved, fmt.Sprintf("%s %s: %s %s (%s)", meta.Kind, meta.Name, target, name, ref.Path))
+					return nil
+				}
+				return field.PipeE(yaml.FieldSetter{StringValue: newName})
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "update name reference %s within %s %s", ref.Path, meta.Kind, meta.Name)
+			}
+		}
+	}
+	return unresolved, nil
+}
+
+func logUnresolvedNameReferences(unresolved []string) {
+	if len(unresolved) > 0 {
+		log.Printf("WARNING: the following references could not be resolved within the chart output and were not renamed:\n * %s", strings.Join(unresolved, "\n * "))
+	}
+}
+
+func nameKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+func stringField(n *yaml.RNode, name string) string {
+	if f := n.Field(name); f != nil && f.Value.YNode().Kind == yaml.ScalarNode {
+		return f.Value.YNode().Value
+	}
+	return ""
+}
@@ -0,0 +1,177 @@
+package helm
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/stretchr/testify/require"
+)
+
+const nameReferencesManifest = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mysecret
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: myserviceaccount
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: myservice
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: myapp
+spec:
+  serviceName: myservice
+  template:
+    spec:
+      serviceAccountName: myserviceaccount
+      containers:
+      - name: app
+        envFrom:
+        - configMapRef:
+            name: myconfig
+        env:
+        - name: PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: mysecret
+              key: password
+        - name: EXTERNAL
+          valueFrom:
+            secretKeyRef:
+              name: external-secret
+              key: password
+      volumes:
+      - name: config
+        configMap:
+          name: myconfig
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      storageClassName: mystorage
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: myclusterrole
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: myclusterrolebinding
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: myclusterrole
+subjects:
+- kind: ServiceAccount
+  name: myserviceaccount
+- kind: User
+  name: someuser
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: mycrds.example.org
+---
+apiVersion: storage.k8s.io/v1
+kind: StorageClass
+metadata:
+  name: mystorage
+provisioner: example.org/provisioner
+---
+apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: myhpa
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: StatefulSet
+    name: myapp
+`
+
+func TestRenameResources(t *testing.T) {
+	testee := manifestTransformer{
+		NamePrefix: "pre-",
+		NameSuffix: "-suf",
+		Includes:   matcher.Any(),
+		Excludes:   matcher.FromResourceSelectors(nil),
+	}
+	r, err := testee.TransformManifest(strings.NewReader(nameReferencesManifest))
+	require.NoError(t, err)
+	names := make([]string, len(r))
+	out := ""
+	for i, o := range r {
+		names[i] = o.GetName()
+		out += o.MustString() + "---\n"
+	}
+	require.Equal(t, []string{
+		"pre-myconfig-suf",
+		"pre-mysecret-suf",
+		"pre-myserviceaccount-suf",
+		"pre-myservice-suf",
+		"pre-myapp-suf",
+		"pre-myclusterrole-suf",
+		"pre-myclusterrolebinding-suf",
+		"mycrds.example.org",
+		"pre-mystorage-suf",
+		"pre-myhpa-suf",
+	}, names, "resource names")
+	for _, s := range []string{
+		"  serviceName: pre-myservice-suf\n",
+		"      serviceAccountName: pre-myserviceaccount-suf\n",
+		"        - configMapRef:\n            name: pre-myconfig-suf\n",
+		"              name: pre-mysecret-suf\n",
+		"              name: external-secret\n",
+		"        configMap:\n          name: pre-myconfig-suf\n",
+		"  kind: ClusterRole\n  name: pre-myclusterrole-suf\n",
+		"- kind: ServiceAccount\n  name: pre-myserviceaccount-suf\n",
+		"- kind: User\n  name: someuser\n",
+		"      storageClassName: pre-mystorage-suf\n",
+		"    kind: StatefulSet\n    name: pre-myapp-suf\n",
+	} {
+		require.Contains(t, out, s)
+	}
+}
+
+func TestRenderNamePrefixWebhookReferences(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	file := filepath.Join(rootDir, "example/webhook/generator.yaml")
+	var rendered bytes.Buffer
+	err := renderFile(t, file, true, rootDir, &rendered)
+	require.NoError(t, err)
+	out := rendered.String()
+	for _, s := range []string{
+		"      name: pre-mywebhook\n      namespace: webhook-namespace\n      path: /validate\n",
+		"      name: pre-mywebhook\n      namespace: webhook-namespace\n      path: /mutate\n",
+		"      name: external-webhook\n      namespace: other-namespace\n",
+		"    name: pre-mywebhook\n    namespace: webhook-namespace\n",
+		"          name: pre-mywebhook\n          namespace: webhook-namespace\n          path: /convert\n",
+	} {
+		require.Contains(t, out, s)
+	}
+	require.Contains(t, logs.String(), "could not be resolved")
+	require.Contains(t, logs.String(), "MutatingWebhookConfiguration pre-mywebhook: Service external-webhook (webhooks/clientConfig/service/name)")
+	require.NotContains(t, logs.String(), "Service mywebhook")
+}
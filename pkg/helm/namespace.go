@@ -0,0 +1,108 @@
+package helm
+
+import (
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// namespaceRewriter sets the namespace within a resource's references to other resources
+type namespaceRewriter interface {
+	RewriteNamespace(o *yaml.RNode, meta *yaml.ResourceMeta, namespace string) error
+}
+
+// namespaceRewriters rewrite the namespace references within well-known kinds
+var namespaceRewriters = []namespaceRewriter{
+	fieldSpecRewriter{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding", Path: "subjects/namespace"},
+	fieldSpecRewriter{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding", Path: "subjects/namespace"},
+	fieldSpecRewriter{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration", Path: "webhooks/clientConfig/service/namespace"},
+	fieldSpecRewriter{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration", Path: "webhooks/clientConfig/service/namespace"},
+	fieldSpecRewriter{Group: "apiregistration.k8s.io", Kind: "APIService", Path: "spec/service/namespace"},
+	fieldSpecRewriter{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition", Path: "spec/conversion/webhook/clientConfig/service/namespace"},
+	fieldSpecRewriter{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition", Path: "spec/conversion/webhookClientConfig/service/namespace"},
+	// See https://cert-manager.io/docs/concepts/ca-injector/
+	annotationRewriter{"cert-manager.io/inject-ca-from", "cert-manager.io/inject-ca-from-secret"},
+}
+
+// fieldSpecRewriter sets the namespace on the field at the configured path within matching resources
+type fieldSpecRewriter config.FieldSpec
+
+func (r fieldSpecRewriter) RewriteNamespace(o *yaml.RNode, meta *yaml.ResourceMeta, namespace string) error {
+	group, version := splitAPIVersion(meta.APIVersion)
+	if r.Kind != "" && r.Kind != meta.Kind || r.Group != "" && r.Group != group || r.Version != "" && r.Version != version {
+		return nil
+	}
+	path := strings.Split(strings.Trim(r.Path, "/"), "/")
+	err := setExistingField(o, namespace, path)
+	return errors.Wrapf(err, "set namespace reference %s within %s %s", r.Path, meta.Kind, meta.Name)
+}
+
+// annotationRewriter sets the namespace within annotations that refer to another resource as <namespace>/<name>
+type annotationRewriter []string
+
+func (r annotationRewriter) RewriteNamespace(o *yaml.RNode, meta *yaml.ResourceMeta, namespace string) error {
+	for _, key := range r {
+		ref := meta.Annotations[key]
+		if i := strings.Index(ref, "/"); i > 0 {
+			if err := setAnnotation(o, key, namespace+ref[i:]); err != nil {
+				return errors.Wrapf(err, "set namespace reference within annotation %s of %s %s", key, meta.Kind, meta.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// effectiveNamespace returns the namespace a resource is applied to:
+// the namespace it specifies or, for namespaced kinds (and those of unknown kinds), the given default namespace.
+func effectiveNamespace(meta *yaml.ResourceMeta, defaultNamespace string) string {
+	if meta.Namespace != "" {
+		return meta.Namespace
+	}
+	if namespaced, knownKind := openapi.IsNamespaceScoped(meta.TypeMeta); namespaced || !knownKind {
+		return defaultNamespace
+	}
+	return ""
+}
+
+func splitAPIVersion(apiVersion string) (group, version string) {
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		return apiVersion[:i], apiVersion[i+1:]
+	}
+	return "", apiVersion
+}
+
+// setExistingField sets the value of the field at the given path if it exists.
+// Sequences along the path are traversed.
+func setExistingField(n *yaml.RNode, value string, path []string) error {
+	return visitFields(n, path, func(_, field *yaml.RNode) error {
+		return field.PipeE(yaml.FieldSetter{StringValue: value})
+	})
+}
+
+// visitFields calls fn with the parent and value node of each existing field at the given path.
+// Sequences along the path are traversed.
+func visitFields(n *yaml.RNode, path []string, fn func(parent, field *yaml.RNode) error) error {
+	if n.YNode().Kind == yaml.SequenceNode {
+		elements, err := n.Elements()
+		if err != nil {
+			return err
+		}
+		for _, e := range elements {
+			if err = visitFields(e, path, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	field := n.Field(path[0])
+	if field == nil || yaml.IsMissingOrNull(field.Value) {
+		return nil
+	}
+	if len(path) == 1 {
+		return fn(n, field.Value)
+	}
+	return visitFields(field.Value, path[1:], fn)
+}
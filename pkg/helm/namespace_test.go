@@ -0,0 +1,119 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+const namespaceReferencesManifest = `---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: mycrds.example.org
+  annotations:
+    cert-manager.io/inject-ca-from: original/mycert
+spec:
+  conversion:
+    strategy: Webhook
+    webhook:
+      clientConfig:
+        service:
+          name: mywebhook
+          namespace: original
+---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: mywebhook
+  annotations:
+    cert-manager.io/inject-ca-from-secret: original/mysecret
+webhooks:
+- name: a.example.org
+  clientConfig:
+    service:
+      name: mywebhook
+      namespace: original
+---
+apiVersion: example.org/v1
+kind: MyKind
+metadata:
+  name: myresource
+spec:
+  targets:
+  - ref:
+      name: a
+      namespace: original
+  - ref:
+      name: b
+      namespace: original
+`
+
+func TestNamespaceRewriters(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		force        string
+		refs         []config.FieldSpec
+		contained    []string
+		notContained []string
+	}{
+		{
+			"no forced namespace",
+			"",
+			[]config.FieldSpec{{Kind: "MyKind", Path: "spec/targets/ref/namespace"}},
+			[]string{"original/mycert", "original/mysecret"},
+			[]string{"forced"},
+		},
+		{
+			"well-known kinds",
+			"forced",
+			nil,
+			[]string{
+				"    cert-manager.io/inject-ca-from: forced/mycert\n",
+				"    cert-manager.io/inject-ca-from-secret: forced/mysecret\n",
+				"          name: mywebhook\n          namespace: forced\n",
+				"      name: mywebhook\n      namespace: forced\n",
+				"      name: a\n      namespace: original\n",
+			},
+			nil,
+		},
+		{
+			"custom field spec",
+			"forced",
+			[]config.FieldSpec{{Group: "example.org", Kind: "MyKind", Path: "spec/targets/ref/namespace"}},
+			[]string{"      name: a\n      namespace: forced\n", "      name: b\n      namespace: forced\n"},
+			[]string{"original"},
+		},
+		{
+			"custom field spec of other group",
+			"forced",
+			[]config.FieldSpec{{Group: "other.org", Kind: "MyKind", Path: "spec/targets/ref/namespace"}},
+			[]string{"      name: a\n      namespace: original\n"},
+			nil,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testee := manifestTransformer{
+				ForceNamespace:      c.force,
+				NamespaceReferences: c.refs,
+				Includes:            matcher.Any(),
+				Excludes:            matcher.FromResourceSelectors(nil),
+			}
+			r, err := testee.TransformManifest(strings.NewReader(namespaceReferencesManifest))
+			require.NoError(t, err)
+			out := ""
+			for _, o := range r {
+				out += o.MustString() + "---\n"
+			}
+			for _, s := range c.contained {
+				require.Contains(t, out, s)
+			}
+			for _, s := range c.notContained {
+				require.NotContains(t, out, s)
+			}
+		})
+	}
+}
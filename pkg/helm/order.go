@@ -0,0 +1,79 @@
+package helm
+
+import (
+	"sort"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+var (
+	// kindOrderFirst lists the kinds that are installed first, derived from kustomize's legacy order
+	kindOrderFirst = []string{
+		"Namespace",
+		"ResourceQuota",
+		"StorageClass",
+		"CustomResourceDefinition",
+		"ServiceAccount",
+		"PodSecurityPolicy",
+		"Role",
+		"ClusterRole",
+		"RoleBinding",
+		"ClusterRoleBinding",
+		"ConfigMap",
+		"Secret",
+		"Endpoints",
+		"Service",
+		"LimitRange",
+		"PriorityClass",
+		"PersistentVolume",
+		"PersistentVolumeClaim",
+		"Deployment",
+		"StatefulSet",
+		"CronJob",
+		"PodDisruptionBudget",
+	}
+	// kindOrderLast lists the kinds that are installed last
+	kindOrderLast = []string{
+		"MutatingWebhookConfiguration",
+		"ValidatingWebhookConfiguration",
+	}
+	kindOrder = func() map[string]int {
+		m := make(map[string]int, len(kindOrderFirst)+len(kindOrderLast))
+		for i, kind := range kindOrderFirst {
+			m[kind] = i - len(kindOrderFirst)
+		}
+		for i, kind := range kindOrderLast {
+			m[kind] = i + 1
+		}
+		return m
+	}()
+)
+
+// sortResources sorts the given resources according to the given order.
+// The helm order is preserved when no order is specified.
+func sortResources(resources []*yaml.RNode, order string) {
+	if order != config.OutputOrderKind && order != config.OutputOrderID {
+		return
+	}
+	ids := make(map[*yaml.RNode]string, len(resources))
+	for _, o := range resources {
+		meta, _ := o.GetMeta()
+		ids[o] = resource.ID(meta)
+	}
+	switch order {
+	case config.OutputOrderKind:
+		sort.SliceStable(resources, func(i, j int) bool {
+			ki, kj := kindOrder[resources[i].GetKind()], kindOrder[resources[j].GetKind()]
+			if ki != kj {
+				return ki < kj
+			}
+			return ids[resources[i]] < ids[resources[j]]
+		})
+	case config.OutputOrderID:
+		sort.SliceStable(resources, func(i, j int) bool {
+			return ids[resources[i]] < ids[resources[j]]
+		})
+	}
+}
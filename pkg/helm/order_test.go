@@ -0,0 +1,69 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+const orderManifest = `---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: mywebhook
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: myapp
+---
+apiVersion: example.org/v1
+kind: MyKind
+metadata:
+  name: mycr
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfigb
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfiga
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: myserviceaccount
+`
+
+func TestOutputOrder(t *testing.T) {
+	for _, c := range []struct {
+		order    string
+		expected []string
+	}{
+		{"", []string{"mywebhook", "myapp", "mycr", "myconfigb", "myconfiga", "myserviceaccount"}},
+		{config.OutputOrderHelm, []string{"mywebhook", "myapp", "mycr", "myconfigb", "myconfiga", "myserviceaccount"}},
+		{config.OutputOrderKind, []string{"myserviceaccount", "myconfiga", "myconfigb", "myapp", "mycr", "mywebhook"}},
+		{config.OutputOrderID, []string{"mywebhook", "myapp", "mycr", "myconfiga", "myconfigb", "myserviceaccount"}},
+	} {
+		t.Run(c.order, func(t *testing.T) {
+			testee := manifestTransformer{
+				OutputOrder: c.order,
+				Includes:    matcher.Any(),
+				Excludes:    matcher.FromResourceSelectors(nil),
+			}
+			r, err := testee.TransformManifest(strings.NewReader(orderManifest))
+			require.NoError(t, err)
+			names := make([]string, len(r))
+			for i, o := range r {
+				names[i] = o.GetName()
+			}
+			require.Equal(t, c.expected, names)
+		})
+	}
+}
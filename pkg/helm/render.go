@@ -12,6 +12,7 @@ import (
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
 	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/action"
@@ -23,27 +24,61 @@ import (
 
 // Render manifest from helm chart configuration (shorthand)
 func (h *Helm) Render(ctx context.Context, req *config.ChartConfig) (r []*yaml.RNode, err error) {
+	if err = prepareRequest(req); err != nil {
+		return nil, err
+	}
+
+	chartRequested, err := h.loadChart(ctx, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load chart %s", req.Chart)
+	}
+
+	r, err = renderChartContext(ctx, chartRequested, req, h.Getters)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Setters) > 0 {
+		if r, err = addSetters(ctx, chartRequested, req, h.Getters, r); err != nil {
+			return nil, err
+		}
+	}
+	if !req.ResolveImageDigests {
+		return r, err
+	}
+	resolver, err := newImageDigestResolver(&req.LoaderConfig, &h.Settings, h.Mirrors, h.ImageDigestMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return r, resolver.ResolveDigests(ctx, r)
+}
+
+// prepareRequest validates the given config and makes its base directory absolute.
+func prepareRequest(req *config.ChartConfig) error {
 	if errs := req.Validate(); len(errs) > 0 {
-		return nil, errors.Errorf("invalid chart renderer config:\n * %s", strings.Join(errs, "\n * "))
+		return errors.Errorf("invalid chart renderer config:\n * %s", strings.Join(errs, "\n * "))
 	}
+	return makeBaseDirAbsolute(req)
+}
+
+// makeBaseDirAbsolute resolves the config's base directory relative to the working directory.
+func makeBaseDirAbsolute(req *config.ChartConfig) error {
 	wd, err := os.Getwd()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 	if req.BaseDir == "" {
 		req.BaseDir = wd
 	} else if !filepath.IsAbs(req.BaseDir) {
 		req.BaseDir = filepath.Join(wd, req.BaseDir)
 	}
+	return nil
+}
 
-	chartRequested, err := h.loadChart(ctx, req)
-	if err != nil {
-		return nil, errors.Wrapf(err, "load chart %s", req.Chart)
-	}
-
+// renderChartContext renders the chart unless the context is cancelled before.
+func renderChartContext(ctx context.Context, chartRequested *chart.Chart, req *config.ChartConfig, getters getter.Providers) (r []*yaml.RNode, err error) {
 	ch := make(chan struct{}, 1)
 	go func() {
-		r, err = renderChart(chartRequested, req, h.Getters)
+		r, err = renderChart(chartRequested, req, getters)
 		ch <- struct{}{}
 	}()
 	select {
@@ -96,17 +131,43 @@ func renderChart(chartRequested *chart.Chart, req *config.ChartConfig, getters g
 	}
 
 	transformer := manifestTransformer{
-		ForceNamespace: req.ForceNamespace,
-		Includes:       inclusions,
-		Excludes:       matcher.FromResourceSelectors(req.Exclude),
-		NamespacedOnly: req.NamespacedOnly,
+		Namespace:                    req.Namespace,
+		ForceNamespace:               req.ForceNamespace,
+		NamespaceLabels:              req.NamespaceLabels,
+		NamespaceAnnotations:         req.NamespaceAnnotations,
+		NamespaceReferences:          req.NamespaceReferences,
+		NamePrefix:                   req.NamePrefix,
+		NameSuffix:                   req.NameSuffix,
+		CommonLabels:                 req.CommonLabels,
+		CommonAnnotations:            req.CommonAnnotations,
+		CommonMetadataInPodTemplates: req.CommonMetadataInPodTemplates,
+		CommonLabelsInSelectors:      req.CommonLabelsInSelectors,
+		Images:                       req.Images,
+		OutputOrder:                  req.OutputOrder,
+		Includes:                     inclusions,
+		Excludes:                     matcher.FromResourceSelectors(req.Exclude),
+		NamespacedOnly:               req.NamespacedOnly,
+		DuplicatePolicy:              req.DuplicatePolicy,
+		PreserveSource:               req.PreserveSource,
+		Hooks: &hookHandler{
+			HookConfig:       req.Hooks,
+			ExcludeByDefault: req.ExcludeHooks,
+			Conversion:       req.HookConversion,
+			Namespace:        req.Namespace,
+		},
+	}
+	if req.CreateNamespace {
+		transformer.CreateNamespace = req.Namespace
+		if req.ForceNamespace != "" {
+			transformer.CreateNamespace = req.ForceNamespace
+		}
 	}
-	chartHookMatcher := matcher.NewChartHookMatcher(transformer.Excludes, !req.ExcludeHooks)
+	chartHookMatcher := matcher.NewChartHookMatcher(transformer.Excludes, transformer.Hooks.Excludes)
 	transformer.Excludes = chartHookMatcher
 
 	manifest := release.Manifest
 	for _, hook := range release.Hooks {
-		manifest += fmt.Sprintf("\n---\n%s", hook.Manifest)
+		manifest += fmt.Sprintf("\n---\n%s%s\n%s", resource.SourceCommentPrefix, hook.Path, hook.Manifest)
 	}
 
 	transformed, err := transformer.TransformManifest(bytes.NewReader([]byte((manifest))))
@@ -123,7 +184,7 @@ func renderChart(chartRequested *chart.Chart, req *config.ChartConfig, getters g
 	if len(transformed) == 0 {
 		return nil, errors.Errorf("chart %s output is empty", chartRequested.Metadata.Name)
 	}
-	if hooks := chartHookMatcher.FoundHooks(); !req.ExcludeHooks && len(hooks) > 0 {
+	if hooks := transformer.Hooks.OutputHooks(chartHookMatcher.FoundHooks()); len(hooks) > 0 {
 		log.Printf("WARNING: Chart output contains the following hooks: %s", strings.Join(hooks, ", "))
 	}
 	return transformed, nil
@@ -48,7 +48,17 @@ func TestRender(t *testing.T) {
 		{"apiversions-condition", "example/apiversions-condition/generator.yaml", []string{}, "  config: fancy-config", nil},
 		{"expand-list", "example/expand-list/generator.yaml", []string{"ns1", "ns2", "ns3"}, "\n  name: myserviceaccount2\n", nil},
 		{"namespace", "example/namespace/generator.yaml", []string{"default-namespace", "cluster-role-binding-ns"}, "  key: b", nil},
-		{"force-namespace", "example/force-namespace/generator.yaml", []string{"forced-namespace"}, "  key: b", nil},
+		{"force-namespace", "example/force-namespace/generator.yaml", []string{"forced-namespace"}, "  key: b", []string{
+			"forced-namespace",
+			"myconfiga",
+			"myconfigb",
+			"myconfigc-with-empty-namespace",
+			"myconfigd-with-namespace-mappingnode",
+			"jenkins-role-binding",
+			"myrolebinding",
+			"v1beta1.metrics.example.org",
+			"mywebhook",
+		}},
 		{"kubeVersion", "example/release-name/generator.yaml", []string{}, "  k8sVersion: v1.17.0", nil},
 		{"release-name", "example/release-name/generator.yaml", []string{}, "  name: my-release-name-config", nil},
 		{"exclude", "example/exclude/generator.yaml", []string{"cluster-role-binding-ns"}, "  key: b", nil},
@@ -59,6 +69,7 @@ func TestRender(t *testing.T) {
 		{"oci-dependency", "example/oci-dependency/generator.yaml", []string{"kube-system", "kube-node-lease"}, "name: ec2nodeclasses.karpenter.k8s.aws", nil},
 		{"values-inheritance", "example/values-inheritance/generator.yaml", []string{}, " inherited: inherited value\n  fileoverwrite: overwritten by file\n  valueoverwrite: overwritten by generator config", nil},
 		{"cluster-scoped", "example/cluster-scoped/generator.yaml", []string{}, "myrolebinding", nil},
+		{"subchart", "example/subchart/generator.yaml", []string{}, "  key: postgresql", []string{"subchart-postgresql", "subchart-app"}},
 		{"chart-hooks", "example/chart-hooks/generator.yaml", []string{"default"}, "  key: myvalue", []string{
 			"chart-hooks-myconfig",
 			"chart-hooks-post-delete",
@@ -193,7 +204,7 @@ func TestRenderUpdateRepositoryIndexIfChartNotFound(t *testing.T) {
 	settings := cli.New()
 	repoURL := "https://charts.rook.io/stable"
 	trust := true
-	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, &trust, settings, getter.All(settings))
+	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, repositoryOptions{trustAnyRepo: &trust, creds: &repositoryCredentials{}}, settings, getter.All(settings))
 	require.NoError(t, err, "use repo")
 	entry, err := repos.Get(repoURL)
 	require.NoError(t, err, "repos.EntryByURL()")
@@ -213,7 +224,7 @@ func TestRenderUpdateRepositoryIndexIfDependencyNotFound(t *testing.T) {
 	settings := cli.New()
 	repoURL := "https://kubernetes-charts.storage.googleapis.com"
 	trust := true
-	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, &trust, settings, getter.All(settings))
+	repos, err := reposForURLs(map[string]struct{}{repoURL: {}}, repositoryOptions{trustAnyRepo: &trust, creds: &repositoryCredentials{}}, settings, getter.All(settings))
 	require.NoError(t, err, "use repo")
 	entry, err := repos.Get(repoURL)
 	require.NoError(t, err, "repos.Get()")
@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/chart"
@@ -23,6 +25,7 @@ import (
 
 type untrustedRepoError struct {
 	error
+	denied bool
 }
 
 func (e *untrustedRepoError) Format(s fmt.State, verb rune) {
@@ -42,23 +45,42 @@ func IsUntrustedRepository(err error) bool {
 	return ok
 }
 
+// IsDeniedRepository returns true if the provided error is an untrusted repository error caused by a trust policy rule
+func IsDeniedRepository(err error) bool {
+	e, ok := errors.Cause(err).(*untrustedRepoError)
+	return ok && e.denied
+}
+
 type repositoryConfig interface {
 	Close() error
 	FilePath() string
 	ResolveChartVersion(ctx context.Context, name, version, repo string) (*repo.ChartVersion, error)
 	Get(repo string) (*repo.Entry, error)
-	UpdateIndex(context.Context) error
+	UpdateIndex(ctx context.Context, repoURLs []string) error
+	RefreshIndex(ctx context.Context, repoURLs []string) error
 	DownloadIndexFilesIfNotExist(context.Context) error
 	RequireTempHelmHome(bool)
 	Apply() (repositoryConfig, error)
 }
 
-func reposForURLs(repoURLs map[string]struct{}, trustAnyRepo *bool, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
+// repositoryOptions specifies how repositories are trusted, authenticated and accessed.
+type repositoryOptions struct {
+	trustAnyRepo *bool
+	trust        trustRules
+	creds        *repositoryCredentials
+	mirrors      Mirrors
+	indexMaxAge  time.Duration
+}
+
+func reposForURLs(repoURLs map[string]struct{}, opts repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
 	repos, err := newRepositories(settings, getters)
 	if err != nil {
 		return nil, err
 	}
-	err = repos.setRepositoriesFromURLs(repoURLs, trustAnyRepo)
+	repos.indexMaxAge = opts.indexMaxAge
+	repos.creds = opts.creds
+	repos.mirrors = opts.mirrors
+	err = repos.setRepositoriesFromURLs(repoURLs, opts.trustAnyRepo, opts.trust, opts.creds)
 	if err != nil {
 		return nil, err
 	}
@@ -66,12 +88,12 @@ func reposForURLs(repoURLs map[string]struct{}, trustAnyRepo *bool, settings *cl
 }
 
 // reposForDependencies create temporary repositories.yaml and configure settings with it.
-func reposForDependencies(deps []*chart.Dependency, trustAnyRepo *bool, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
+func reposForDependencies(deps []*chart.Dependency, opts repositoryOptions, settings *cli.EnvSettings, getters getter.Providers) (repositoryConfig, error) {
 	repoURLs := map[string]struct{}{}
 	for _, d := range deps {
 		repoURLs[d.Repository] = struct{}{}
 	}
-	repos, err := reposForURLs(repoURLs, trustAnyRepo, settings, getters)
+	repos, err := reposForURLs(repoURLs, opts, settings, getters)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +105,10 @@ type repositories struct {
 	repos        *repo.File
 	repoURLMap   map[string]*repo.Entry
 	getters      getter.Providers
+	creds        *repositoryCredentials
+	mirrors      Mirrors
 	cacheDir     string
+	indexMaxAge  time.Duration
 	entriesAdded bool
 	indexFiles   map[string]*repo.IndexFile
 }
@@ -129,7 +154,7 @@ func (f *repositories) repoIndex(ctx context.Context, entry *repo.Entry) (*repo.
 	idx, err := loadIndexFile(ctx, idxFile)
 	if err != nil {
 		if os.IsNotExist(errors.Cause(err)) {
-			err = downloadIndexFile(ctx, entry, f.cacheDir, f.getters)
+			err = f.downloadIndexFile(ctx, entry)
 			if err != nil {
 				return nil, err
 			}
@@ -148,7 +173,7 @@ func (f *repositories) repoIndex(ctx context.Context, entry *repo.Entry) (*repo.
 func loadIndexFile(ctx context.Context, idxFile string) (idx *repo.IndexFile, err error) {
 	done := make(chan struct{}, 1)
 	go func() {
-		idx, err = repo.LoadIndexFile(idxFile)
+		idx, err = loadCachedIndexFile(idxFile)
 		close(done)
 	}()
 	select {
@@ -179,7 +204,7 @@ func (f *repositories) ResolveChartVersion(ctx context.Context, name, version, r
 	cv, err := idx.Get(name, version)
 	if err != nil {
 		// Download latest index file and retry lookup if not found
-		err = downloadIndexFile(ctx, entry, f.cacheDir, f.getters)
+		err = f.downloadIndexFile(ctx, entry)
 		if err != nil {
 			return nil, errors.Wrapf(err, "repo index download after %s not found", errMsg)
 		}
@@ -242,37 +267,63 @@ func (f *repositories) DownloadIndexFilesIfNotExist(ctx context.Context) error {
 		if _, err := os.Stat(indexFile(r, f.cacheDir)); err == nil {
 			continue // do not update existing repo index
 		}
-		if err := downloadIndexFile(ctx, r, f.cacheDir, f.getters); err != nil {
+		if err := f.downloadIndexFile(ctx, r); err != nil {
 			return errors.Wrap(err, "download repo index")
 		}
 	}
 	return nil
 }
 
-func (f *repositories) UpdateIndex(ctx context.Context) error {
-	for _, r := range f.repos.Repositories {
-		if err := downloadIndexFile(ctx, r, f.cacheDir, f.getters); err != nil {
+// UpdateIndex updates the index files of the given repositories unless they have been updated within the max age.
+func (f *repositories) UpdateIndex(ctx context.Context, repoURLs []string) error {
+	return f.updateIndex(ctx, repoURLs, f.indexMaxAge)
+}
+
+// RefreshIndex updates the index files of the given repositories regardless of their age.
+func (f *repositories) RefreshIndex(ctx context.Context, repoURLs []string) error {
+	return f.updateIndex(ctx, repoURLs, 0)
+}
+
+func (f *repositories) updateIndex(ctx context.Context, repoURLs []string, maxAge time.Duration) error {
+	for _, u := range repoURLs {
+		r, err := f.Get(u)
+		if err != nil {
+			return err
+		}
+		if isFileFresh(indexFile(r, f.cacheDir), maxAge) {
+			log.Printf("Using cached repository index of %s", r.URL)
+			continue
+		}
+		if err = f.downloadIndexFile(ctx, r); err != nil {
 			return errors.Wrap(err, "download repo index")
 		}
 	}
 	return nil
 }
 
-func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, trustAnyRepo *bool) error {
+func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, trustAnyRepo *bool, trust trustRules, creds *repositoryCredentials) error {
 	requiredRepos := make([]*repo.Entry, 0, len(repoURLs))
 	repoURLMap := map[string]*repo.Entry{}
+	allowedURLs := map[string]bool{}
 	for u := range repoURLs {
 		repo, _ := f.Get(u)
 		if repo != nil {
 			u = repo.URL
 		} else if strings.HasPrefix(u, "alias:") || strings.HasPrefix(u, "@") {
 			return errors.Errorf("repository %q not found in repositories.yaml", u)
-		} else if trustAnyRepo != nil && !*trustAnyRepo || trustAnyRepo == nil && f.repos != nil {
+		}
+		rule := trust.evaluate(u)
+		if rule != nil && rule.Action == TrustActionDeny {
+			return &untrustedRepoError{errors.Errorf("repository %q is denied by trust rule %s", u, rule), true}
+		}
+		allow := rule != nil
+		allowedURLs[u] = allow
+		if repo == nil && !allow && (trustAnyRepo != nil && !*trustAnyRepo || trustAnyRepo == nil && f.repos != nil) {
 			err := errors.Errorf("repository %q not found in %s and usage of untrusted repositories is disabled", u, f.filePath)
 			if f.repos == nil {
 				err = errors.Errorf("request repository %q: %s does not exist and usage of untrusted repositories is disabled", u, f.filePath)
 			}
-			return &untrustedRepoError{err}
+			return &untrustedRepoError{err, false}
 		}
 		repoURLMap[u] = repo
 	}
@@ -299,10 +350,17 @@ func (f *repositories) setRepositoriesFromURLs(repoURLs map[string]struct{}, tru
 		}
 	}
 
+	// Apply credentials that are not specified within repositories.yaml
+	for _, entry := range f.repos.Repositories {
+		if creds.apply(entry) {
+			f.entriesAdded = true
+		}
+	}
+
 	// Log repository usage
 	repoUsage := make([]string, len(f.repos.Repositories))
 	for i, entry := range f.repos.Repositories {
-		if repo := repoURLMap[entry.URL]; repo != nil || trustAnyRepo != nil {
+		if repo := repoURLMap[entry.URL]; repo != nil || trustAnyRepo != nil || allowedURLs[entry.URL] {
 			authInfo := "unauthenticated"
 			if entry.Username != "" && entry.Password != "" {
 				authInfo = fmt.Sprintf("as user %q", entry.Username)
@@ -364,57 +422,76 @@ func (f *tempRepositories) Close() error {
 	return os.Remove(f.tmpFile)
 }
 
-func downloadIndexFile(ctx context.Context, entry *repo.Entry, cacheDir string, getters getter.Providers) error {
+// downloadIndexFile downloads the repository's index file.
+// The index of an HTTP repository is downloaded from its mirror (if any) using a conditional request.
+// Indices of other repositories are downloaded using the getters.
+func (f *repositories) downloadIndexFile(ctx context.Context, entry *repo.Entry) error {
 	log.Printf("Downloading repository index of %s", entry.URL)
-	idxFile := indexFile(entry, cacheDir)
-	err := os.MkdirAll(filepath.Dir(idxFile), 0750)
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return errors.Wrapf(err, "parse repository URL %q", entry.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return downloadIndexFile(ctx, entry, f.cacheDir, f.getters)
+	}
+	indexURL, err := repo.ResolveReferenceURL(entry.URL, "index.yaml")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	tmpIdxFile, err := os.CreateTemp(filepath.Dir(idxFile), fmt.Sprintf(".tmp-%s-index", entry.Name))
+	idxFile := indexFile(entry, f.cacheDir)
+	if mirror := f.mirrors.find(indexURL); mirror != nil {
+		// Like the mirror getter use the credentials configured for the mirror
+		mirrorEntry := &repo.Entry{URL: mirror.Replacement}
+		if f.creds != nil {
+			f.creds.apply(mirrorEntry)
+		}
+		err = downloadHTTPIndexFile(ctx, mirror.rewrite(indexURL), mirrorEntry, idxFile)
+	} else {
+		err = downloadHTTPIndexFile(ctx, indexURL, entry, idxFile)
+	}
+	return errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", entry.URL)
+}
+
+// downloadIndexFile downloads the repository's index file using the given getters.
+// Since helm's getters cannot send conditional requests an unchanged index is detected by its digest:
+// the cached file is kept, preserving its parsed representation, and only its mtime is updated.
+func downloadIndexFile(ctx context.Context, entry *repo.Entry, cacheDir string, getters getter.Providers) error {
+	indexURL, err := repo.ResolveReferenceURL(entry.URL, "index.yaml")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	tmpIdxFileName := tmpIdxFile.Name()
-	_ = tmpIdxFile.Close()
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return errors.Wrapf(err, "parse repository URL %q", entry.URL)
+	}
+	g, err := getters.ByScheme(u.Scheme)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	idxFile := indexFile(entry, cacheDir)
 
 	interrupt := ctx.Done()
 	done := make(chan error, 1)
 	go func() {
-		var err error
-		defer func() {
-			done <- err
-			close(done)
-			if err != nil {
-				_ = os.Remove(tmpIdxFileName)
-			}
-		}()
-		tmpEntry := *entry
-		tmpEntry.Name = filepath.Base(tmpIdxFileName)
-		r, err := repo.NewChartRepository(&tmpEntry, getters)
+		defer close(done)
+		// Options as passed by helm's ChartRepository.DownloadIndexFile()
+		b, err := g.Get(indexURL,
+			getter.WithURL(entry.URL),
+			getter.WithInsecureSkipVerifyTLS(entry.InsecureSkipTLSverify),
+			getter.WithTLSClientConfig(entry.CertFile, entry.KeyFile, entry.CAFile),
+			getter.WithBasicAuth(entry.Username, entry.Password),
+			getter.WithPassCredentialsAll(entry.PassCredentialsAll),
+		)
 		if err != nil {
-			err = errors.WithStack(err)
+			done <- errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", entry.URL)
 			return
 		}
-		r.CachePath = filepath.Dir(tmpIdxFileName)
-		tmpIdxFileName, err = r.DownloadIndexFile()
-		if err != nil {
-			err = errors.Wrapf(err, "looks like %q is not a valid chart repository or cannot be reached", entry.URL)
-			return
-		}
-		err = os.Rename(tmpIdxFileName, idxFile)
-		if os.IsExist(err) {
-			// Ignore error if file was downloaded by another process concurrently.
-			// This fixes a race condition, see https://github.com/mgoltzsche/khelm/issues/36
-			err = os.Remove(tmpIdxFileName)
-		}
-		err = errors.WithStack(err)
+		done <- writeIndexFileIfChanged(b.Bytes(), idxFile, entry.URL)
 	}()
 	select {
 	case err := <-done:
 		return err
 	case <-interrupt:
-		_ = os.Remove(tmpIdxFileName)
 		return ctx.Err()
 	}
 }
@@ -0,0 +1,131 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/getter"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const setterCommentPrefix = "# kpt-set: "
+
+// addSetters annotates the fields that contain the configured values with kpt setter comments
+// and appends the corresponding apply-setters function config to the resources.
+// See https://catalog.kpt.dev/apply-setters/v0.2/
+func addSetters(ctx context.Context, chartRequested *chart.Chart, req *config.ChartConfig, getters getter.Providers, resources []*yaml.RNode) ([]*yaml.RNode, error) {
+	paths := make([]string, 0, len(req.Setters))
+	for p := range req.Setters {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	values, sentinels, traced, err := renderSentinels(ctx, chartRequested, req, getters, paths)
+	if err != nil {
+		return nil, errors.Wrap(err, "setters")
+	}
+	byID := make(map[string]*yaml.RNode, len(resources))
+	for _, o := range resources {
+		if meta, err := o.GetMeta(); err == nil {
+			byID[resource.ID(meta)] = o
+		}
+	}
+	replacer := make([]string, 0, 2*len(paths))
+	for i, p := range paths {
+		replacer = append(replacer, sentinels[i], fmt.Sprintf("${%s}", req.Setters[p]))
+	}
+	sentinelReplacer := strings.NewReplacer(replacer...)
+	used := map[string]bool{}
+	for _, t := range traced {
+		meta, err := t.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		o := byID[resource.ID(meta)]
+		if o == nil || !checkSentinelsInID(meta, paths, sentinels) {
+			continue
+		}
+		err = traceFields(t, nil, func(fieldPath []string, value string) {
+			comment := sentinelReplacer.Replace(value)
+			if comment == value {
+				return
+			}
+			for i, sentinel := range sentinels {
+				if strings.Contains(value, sentinel) {
+					used[paths[i]] = true
+				}
+			}
+			if field := lookupTracedField(o, fieldPath); field != nil {
+				field.YNode().LineComment = setterCommentPrefix + comment
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "add setters to %s %s", meta.Kind, meta.Name)
+		}
+	}
+	data := make(map[string]interface{}, len(paths))
+	for i, p := range paths {
+		if !used[p] {
+			log.Printf("WARNING: setter %s: value %s is not used within the chart output", req.Setters[p], p)
+		}
+		data[req.Setters[p]] = values[i]
+	}
+	settersConfig, err := yaml.FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":        req.Name + "-setters",
+			"annotations": map[string]interface{}{filters.LocalConfigAnnotation: "true"},
+		},
+		"data": data,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "generate setters config")
+	}
+	return append(resources, settersConfig), nil
+}
+
+// lookupTracedField returns the node at the given path as returned by traceFields.
+func lookupTracedField(n *yaml.RNode, path []string) *yaml.RNode {
+	for _, segment := range path {
+		switch n.YNode().Kind {
+		case yaml.MappingNode:
+			f := n.Field(segment)
+			if f == nil {
+				return nil
+			}
+			n = f.Value
+		case yaml.SequenceNode:
+			elements, err := n.Elements()
+			if err != nil {
+				return nil
+			}
+			n = nil
+			if strings.HasPrefix(segment, "[name=") {
+				name := strings.TrimSuffix(strings.TrimPrefix(segment, "[name="), "]")
+				for _, e := range elements {
+					if e.YNode().Kind == yaml.MappingNode && stringField(e, yaml.NameField) == name {
+						n = e
+						break
+					}
+				}
+			} else if i, err := strconv.Atoi(segment); err == nil && i < len(elements) {
+				n = elements[i]
+			}
+			if n == nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	return n
+}
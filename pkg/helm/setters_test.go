@@ -0,0 +1,80 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderSetters(t *testing.T) {
+	req := config.NewChartConfig()
+	req.Chart = filepath.Join(rootDir, "example", "kustomization-values")
+	req.Name = "release-name"
+	req.Setters = map[string]string{
+		"image.repository": "image",
+		"image.tag":        "tag",
+		"replicaCount":     "replicas",
+	}
+	var buf bytes.Buffer
+	err := render(t, *req, false, &buf)
+	require.NoError(t, err)
+	for _, s := range []string{
+		"\n  replicas: 1 # kpt-set: ${replicas}\n",
+		"\n        image: \"nginx:1.25\" # kpt-set: ${image}:${tag}\n",
+		"\n  image: nginx\n  replicas: \"1\"\n  tag: \"1.25\"\n",
+		"\n    config.kubernetes.io/local-config: \"true\"\n  name: release-name-setters\n",
+	} {
+		require.Contains(t, buf.String(), s)
+	}
+
+	req.Values = map[string]interface{}{"unused": "value"}
+	req.Setters = map[string]string{"replicaCount": "replicas", "unused": "unused"}
+	buf.Reset()
+	err = render(t, *req, false, &buf)
+	require.NoError(t, err, "unused value")
+	require.Contains(t, buf.String(), "\n  replicas: \"1\"\n  unused: value\n")
+
+	req.Setters = map[string]string{"unknown": "unknown"}
+	_, err = NewHelm().Render(context.Background(), req)
+	require.Error(t, err, "unknown value")
+}
+
+func TestRenderSettersWithImageDigests(t *testing.T) {
+	digest := "sha256:24a0c4b4a4c0eb97a1aabb8e29f18e917d05abfe1b7a7c07857230879ce7d3d3"
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", "512")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer registry.Close()
+	t.Setenv("HELM_REPOSITORY_CACHE", t.TempDir())
+	image := strings.TrimPrefix(registry.URL, "http://") + "/myorg/app"
+	req := config.NewChartConfig()
+	req.Chart = filepath.Join(rootDir, "example", "kustomization-values")
+	req.Name = "release-name"
+	req.Values = map[string]interface{}{"image": map[string]interface{}{"repository": image, "tag": "1.0"}}
+	req.ResolveImageDigests = true
+
+	// The digest is not resolved for an image that is configurable using a setter
+	req.Setters = map[string]string{"image.repository": "image", "image.tag": "tag"}
+	var buf bytes.Buffer
+	err := render(t, *req, false, &buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "\n        image: \""+image+":1.0\" # kpt-set: ${image}:${tag}\n")
+
+	// The digest is resolved for images without setter
+	req.Setters = map[string]string{"replicaCount": "replicas"}
+	buf.Reset()
+	err = render(t, *req, false, &buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "\n        image: \""+image+":1.0@"+digest+"\"\n")
+	require.Contains(t, buf.String(), "\n  replicas: 1 # kpt-set: ${replicas}\n")
+}
@@ -0,0 +1,193 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/strvals"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// traceDelimiters are the delimiters that are tried to locate a value within a field that contains other text as well
+var traceDelimiters = []string{":", "@", "/", "=", ",", " ", "-", "."}
+
+// ValueUsage describes where a chart value ends up within the rendered resources.
+type ValueUsage = resource.ValueUsage
+
+// ValueTarget specifies a resource field that contains a chart value.
+type ValueTarget = resource.ValueTarget
+
+// TraceValues renders the chart with sentinel values at the given value paths and returns the fields they end up in.
+func (h *Helm) TraceValues(ctx context.Context, req *config.ChartConfig, paths []string) ([]ValueUsage, error) {
+	if err := prepareRequest(req); err != nil {
+		return nil, err
+	}
+	chartRequested, err := h.loadChart(ctx, req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load chart %s", req.Chart)
+	}
+	values, sentinels, resources, err := renderSentinels(ctx, chartRequested, req, h.Getters, paths)
+	if err != nil {
+		return nil, errors.Wrap(err, "trace values")
+	}
+	usages := make([]resource.ValueUsage, len(paths))
+	for i, p := range paths {
+		usages[i] = resource.ValueUsage{Path: p, Value: values[i]}
+	}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if !checkSentinelsInID(meta, paths, sentinels) {
+			continue
+		}
+		err = traceFields(o, nil, func(fieldPath []string, value string) {
+			for i, sentinel := range sentinels {
+				if !strings.Contains(value, sentinel) {
+					continue
+				}
+				target := resource.ValueTarget{
+					APIVersion: meta.APIVersion,
+					Kind:       meta.Kind,
+					Namespace:  meta.Namespace,
+					Name:       meta.Name,
+					FieldPath:  strings.Join(fieldPath, "."),
+				}
+				if value != sentinel {
+					target.Delimiter, target.Index = findDelimited(value, sentinel)
+					if target.Delimiter == "" {
+						log.Printf("WARNING: value %s is used within field %s of %s %s in a way that cannot be replaced", paths[i], target.FieldPath, meta.Kind, meta.Name)
+						continue
+					}
+				}
+				usages[i].Targets = append(usages[i].Targets, target)
+			}
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "trace values within %s %s", meta.Kind, meta.Name)
+		}
+	}
+	for _, u := range usages {
+		if len(u.Targets) == 0 {
+			log.Printf("WARNING: value %s is not used within the chart output", u.Path)
+		}
+	}
+	return usages, nil
+}
+
+// renderSentinels renders the chart with a unique sentinel value at each of the given value paths.
+// It returns the actual values, the sentinels and the rendered resources.
+func renderSentinels(ctx context.Context, chartRequested *chart.Chart, req *config.ChartConfig, getters getter.Providers, paths []string) (values, sentinels []string, resources []*yaml.RNode, err error) {
+	vals, err := loadValues(req, getters)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vals, err = chartutil.CoalesceValues(chartRequested, vals)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "coalesce values")
+	}
+	values = make([]string, len(paths))
+	sentinels = make([]string, len(paths))
+	overrides := map[string]interface{}{}
+	for i, p := range paths {
+		v, err := chartutil.Values(vals).PathValue(p)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "value %s (only scalar values are supported)", p)
+		}
+		values[i] = valueString(v)
+		sentinels[i] = fmt.Sprintf("khelmvalue%dsentinel", i)
+		if err = strvals.ParseIntoString(fmt.Sprintf("%s=%s", p, sentinels[i]), overrides); err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "value %s", p)
+		}
+	}
+	sentinelReq := *req
+	sentinelReq.Values = chartutil.MergeTables(overrides, copyValues(req.Values))
+	resources, err = renderChartContext(ctx, chartRequested, &sentinelReq, getters)
+	return values, sentinels, resources, err
+}
+
+// valueString returns the string representation of a scalar chart value.
+// Numbers are parsed as float64 from YAML, which fmt would print in exponent notation when large.
+func valueString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// checkSentinelsInID returns false and logs a warning if a sentinel is contained within the resource's name or namespace.
+func checkSentinelsInID(meta yaml.ResourceMeta, paths, sentinels []string) bool {
+	for i, sentinel := range sentinels {
+		if strings.Contains(meta.Name, sentinel) || strings.Contains(meta.Namespace, sentinel) {
+			log.Printf("WARNING: value %s is used within the name or namespace of %s %s and cannot be traced within the resource", paths[i], meta.Kind, meta.Name)
+			return false
+		}
+	}
+	return true
+}
+
+// traceFields calls fn with the kustomize field path and value of each scalar field.
+// Sequence items are addressed by name if they have one, otherwise by index.
+func traceFields(n *yaml.RNode, path []string, fn func(path []string, value string)) error {
+	switch n.YNode().Kind {
+	case yaml.ScalarNode:
+		fn(path, n.YNode().Value)
+	case yaml.MappingNode:
+		return n.VisitFields(func(f *yaml.MapNode) error {
+			key := f.Key.YNode().Value
+			if strings.Contains(key, ".") {
+				// kustomize cannot address keys that contain dots
+				return nil
+			}
+			return traceFields(f.Value, append(path[:len(path):len(path)], key), fn)
+		})
+	case yaml.SequenceNode:
+		elements, err := n.Elements()
+		if err != nil {
+			return err
+		}
+		for i, e := range elements {
+			segment := strconv.Itoa(i)
+			if e.YNode().Kind == yaml.MappingNode && stringField(e, yaml.NameField) != "" {
+				segment = fmt.Sprintf("[name=%s]", stringField(e, yaml.NameField))
+			}
+			if err = traceFields(e, append(path[:len(path):len(path)], segment), fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findDelimited returns the delimiter and index that isolate the sentinel within the given value.
+func findDelimited(value, sentinel string) (string, int) {
+	for _, d := range traceDelimiters {
+		for i, s := range strings.Split(value, d) {
+			if s == sentinel {
+				return d, i
+			}
+		}
+	}
+	return "", 0
+}
+
+func copyValues(v map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(v))
+	for k, e := range v {
+		if m, ok := e.(map[string]interface{}); ok {
+			e = copyValues(m)
+		}
+		c[k] = e
+	}
+	return c
+}
@@ -0,0 +1,50 @@
+package helm
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceValues(t *testing.T) {
+	req := config.NewChartConfig()
+	req.Chart = filepath.Join(rootDir, "example", "kustomization-values")
+	req.Name = "myrelease"
+	req.Values = map[string]interface{}{"image": map[string]interface{}{"tag": "1.26"}}
+	usages, err := NewHelm().TraceValues(context.Background(), req, []string{"image.tag", "replicaCount", "logLevel"})
+	require.NoError(t, err)
+	target := resource.ValueTarget{APIVersion: "apps/v1", Kind: "Deployment", Name: "myrelease-app"}
+	imageTarget := target
+	imageTarget.FieldPath = "spec.template.spec.containers.[name=app].image"
+	imageTarget.Delimiter = ":"
+	imageTarget.Index = 1
+	replicasTarget := target
+	replicasTarget.FieldPath = "spec.replicas"
+	logLevelTarget := target
+	logLevelTarget.FieldPath = "spec.template.spec.containers.[name=app].env.[name=LOG_LEVEL].value"
+	require.Equal(t, []resource.ValueUsage{
+		{Path: "image.tag", Value: "1.26", Targets: []resource.ValueTarget{imageTarget}},
+		{Path: "replicaCount", Value: "1", Targets: []resource.ValueTarget{replicasTarget}},
+		{Path: "logLevel", Value: "info", Targets: []resource.ValueTarget{logLevelTarget}},
+	}, usages)
+
+	for _, path := range []string{"unknown", "image"} {
+		_, err = NewHelm().TraceValues(context.Background(), req, []string{path})
+		require.Error(t, err, "trace %s", path)
+	}
+}
+
+func TestTraceValuesNumberFormat(t *testing.T) {
+	req := config.NewChartConfig()
+	req.Chart = filepath.Join(rootDir, "example", "kustomization-values")
+	req.Name = "myrelease"
+	req.Values = map[string]interface{}{"replicaCount": float64(1000000)}
+	usages, err := NewHelm().TraceValues(context.Background(), req, []string{"replicaCount"})
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	require.Equal(t, "1000000", usages[0].Value)
+}
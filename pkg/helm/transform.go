@@ -3,22 +3,113 @@ package helm
 import (
 	"fmt"
 	"io"
+	"log"
 	"strings"
 
 	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
 	"github.com/pkg/errors"
 	"sigs.k8s.io/kustomize/kyaml/openapi"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
 )
 
 type manifestTransformer struct {
-	ForceNamespace string
-	Includes       matcher.ResourceMatchers
-	Excludes       matcher.ResourceMatchers
-	NamespacedOnly bool
+	Namespace                    string
+	ForceNamespace               string
+	CreateNamespace              string
+	NamespaceLabels              map[string]string
+	NamespaceAnnotations         map[string]string
+	NamespaceReferences          []config.FieldSpec
+	NamePrefix                   string
+	NameSuffix                   string
+	CommonLabels                 map[string]string
+	CommonAnnotations            map[string]string
+	CommonMetadataInPodTemplates bool
+	CommonLabelsInSelectors      bool
+	Images                       []config.Image
+	OutputOrder                  string
+	Includes                     matcher.ResourceMatchers
+	Excludes                     matcher.ResourceMatchers
+	NamespacedOnly               bool
+	DuplicatePolicy              string
+	PreserveSource               string
+	Hooks                        *hookHandler
 }
 
-func (t *manifestTransformer) TransformManifest(manifest io.Reader) (r []*yaml.RNode, err error) {
+// manifestResource is a resource along with the chart template it originates from.
+type manifestResource struct {
+	*yaml.RNode
+	Source string
+}
+
+func (t *manifestTransformer) TransformManifest(manifest io.Reader) ([]*yaml.RNode, error) {
+	resources, err := t.decodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	resources, err = t.handleDuplicates(resources)
+	if err != nil {
+		return nil, err
+	}
+	unresolved, err := t.renameResources(resources)
+	if err != nil {
+		return nil, err
+	}
+	logUnresolvedNameReferences(unresolved)
+	if err = t.applyImages(resources); err != nil {
+		return nil, err
+	}
+	if t.Hooks != nil {
+		if err = t.Hooks.Transform(resources); err != nil {
+			return nil, err
+		}
+	}
+	r := make([]*yaml.RNode, 0, len(resources)+1)
+	if t.CreateNamespace != "" {
+		ns, err := t.namespaceResource(resources)
+		if err != nil {
+			return nil, err
+		}
+		if ns != nil {
+			r = append(r, ns)
+		}
+	}
+	for _, o := range resources {
+		r = append(r, o.RNode)
+	}
+	if err = t.applyCommonMetadata(r); err != nil {
+		return nil, err
+	}
+	sortResources(r, t.OutputOrder)
+	return r, nil
+}
+
+// namespaceResource creates the Namespace resource unless the chart output contains it already.
+func (t *manifestTransformer) namespaceResource(resources []manifestResource) (*yaml.RNode, error) {
+	for _, o := range resources {
+		if o.GetApiVersion() == "v1" && o.GetKind() == "Namespace" && o.GetName() == t.CreateNamespace {
+			log.Printf("WARNING: not creating Namespace %s since the chart output contains it already", t.CreateNamespace)
+			return nil, nil
+		}
+	}
+	metadata := map[string]interface{}{"name": t.CreateNamespace}
+	if len(t.NamespaceLabels) > 0 {
+		metadata["labels"] = t.NamespaceLabels
+	}
+	if len(t.NamespaceAnnotations) > 0 {
+		metadata["annotations"] = t.NamespaceAnnotations
+	}
+	ns, err := yaml.FromMap(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   metadata,
+	})
+	return ns, errors.Wrap(err, "create namespace resource")
+}
+
+func (t *manifestTransformer) decodeManifest(manifest io.Reader) (r []manifestResource, err error) {
 	clusterScopedResources := []string{}
 	d := yaml.NewDecoder(manifest)
 	for {
@@ -33,7 +124,7 @@ func (t *manifestTransformer) TransformManifest(manifest io.Reader) (r []*yaml.R
 			continue
 		}
 
-		err = t.addResources(o, &r, &clusterScopedResources)
+		err = t.addResources(o, resource.SourceTemplate(o), &r, &clusterScopedResources)
 		if err != nil {
 			break
 		}
@@ -50,7 +141,7 @@ func (t *manifestTransformer) TransformManifest(manifest io.Reader) (r []*yaml.R
 	return
 }
 
-func (t *manifestTransformer) addResources(o *yaml.RNode, r *[]*yaml.RNode, clusterScopedResources *[]string) error {
+func (t *manifestTransformer) addResources(o *yaml.RNode, source string, r *[]manifestResource, clusterScopedResources *[]string) error {
 	meta, err := o.GetMeta()
 	if err != nil {
 		return err
@@ -63,7 +154,7 @@ func (t *manifestTransformer) addResources(o *yaml.RNode, r *[]*yaml.RNode, clus
 				return errors.Wrap(err, "get List resource items")
 			}
 			for _, item := range items {
-				if err = t.addResources(item, r, clusterScopedResources); err != nil {
+				if err = t.addResources(item, source, r, clusterScopedResources); err != nil {
 					return err
 				}
 			}
@@ -71,6 +162,14 @@ func (t *manifestTransformer) addResources(o *yaml.RNode, r *[]*yaml.RNode, clus
 		return nil
 	}
 
+	// Let the matchers select resources by source template
+	if source != "" {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[config.AnnotationSource] = source
+	}
+
 	// Exclude all not explicitly included resources
 	if !t.Includes.Match(&meta) {
 		return nil
@@ -86,10 +185,97 @@ func (t *manifestTransformer) addResources(o *yaml.RNode, r *[]*yaml.RNode, clus
 	if err != nil {
 		return err
 	}
-	*r = append(*r, o)
+
+	// Preserve source template path
+	if source != "" {
+		switch t.PreserveSource {
+		case config.PreserveSourceAnnotation:
+			err = setAnnotation(o, config.AnnotationSource, source)
+		case config.PreserveSourceComment:
+			setSourceComment(o, source)
+		}
+		if err != nil {
+			return errors.Wrap(err, "set source annotation")
+		}
+	}
+	*r = append(*r, manifestResource{o, source})
 	return nil
 }
 
+// handleDuplicates detects resources with the same ID and resolves them according to the DuplicatePolicy.
+func (t *manifestTransformer) handleDuplicates(resources []manifestResource) ([]manifestResource, error) {
+	r := make([]manifestResource, 0, len(resources))
+	indices := map[string]int{}
+	for _, o := range resources {
+		meta, err := o.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("apiVersion: %s, kind: %s, namespace: %s, name: %s", meta.APIVersion, meta.Kind, effectiveNamespace(&meta, t.Namespace), meta.Name)
+		i, found := indices[id]
+		if !found {
+			indices[id] = len(r)
+			r = append(r, o)
+			continue
+		}
+		sources := fmt.Sprintf("%s and %s", sourceName(r[i].Source), sourceName(o.Source))
+		switch t.DuplicatePolicy {
+		case config.DuplicatePolicyKeepFirst:
+			log.Printf("WARNING: ignoring duplicate resource %s (found in %s)", id, sources)
+		case config.DuplicatePolicyKeepLast:
+			log.Printf("WARNING: replacing duplicate resource %s (found in %s)", id, sources)
+			r[i] = o
+		case config.DuplicatePolicyMerge:
+			log.Printf("WARNING: merging duplicate resource %s (found in %s)", id, sources)
+			merged, err := merge2.Merge(o.RNode, r[i].RNode, yaml.MergeOptions{ListIncreaseDirection: yaml.MergeOptionsListAppend})
+			if err != nil {
+				return nil, errors.Wrapf(err, "merge duplicate resource %s (found in %s)", id, sources)
+			}
+			r[i].RNode = merged
+		default:
+			return nil, errors.Errorf("chart output contains duplicate resource %s (found in %s). "+
+				"Please exclude one of them or set duplicatePolicy to %s, %s or %s",
+				id, sources, config.DuplicatePolicyKeepFirst, config.DuplicatePolicyKeepLast, config.DuplicatePolicyMerge)
+		}
+	}
+	return r, nil
+}
+
+// setAnnotation sets an annotation on the given resource.
+func setAnnotation(o *yaml.RNode, key, value string) error {
+	// Remove annotations field if empty since LookupCreate() doesn't create the MappingNode if it exists but is empty (#13).
+	err := o.PipeE(yaml.LookupCreate(yaml.MappingNode, yaml.MetadataField), yaml.FieldClearer{Name: yaml.AnnotationsField, IfEmpty: true})
+	if err != nil {
+		return err
+	}
+	return o.PipeE(yaml.LookupCreate(yaml.MappingNode, yaml.MetadataField, yaml.AnnotationsField), yaml.FieldSetter{Name: key, StringValue: value})
+}
+
+// setSourceComment replaces the source comment within the resource's header.
+func setSourceComment(o *yaml.RNode, source string) {
+	n := o.YNode()
+	if n.Kind != yaml.MappingNode || len(n.Content) == 0 {
+		return
+	}
+	comments := []string{resource.SourceCommentPrefix + source}
+	for _, c := range []string{n.HeadComment, n.Content[0].HeadComment} {
+		for _, line := range strings.Split(c, "\n") {
+			if line != "" && !strings.HasPrefix(line, resource.SourceCommentPrefix) {
+				comments = append(comments, line)
+			}
+		}
+	}
+	n.HeadComment = ""
+	n.Content[0].HeadComment = strings.Join(comments, "\n")
+}
+
+func sourceName(source string) string {
+	if source == "" {
+		return "unknown template"
+	}
+	return source
+}
+
 func (t *manifestTransformer) applyNamespace(o *yaml.RNode, clusterScopedResources *[]string) error {
 	meta, err := o.GetMeta()
 	if err != nil {
@@ -115,15 +301,16 @@ func (t *manifestTransformer) applyNamespace(o *yaml.RNode, clusterScopedResourc
 		resID := fmt.Sprintf("apiVersion: %s, kind: %s, name: %s", meta.APIVersion, meta.Kind, meta.Name)
 		*clusterScopedResources = append(*clusterScopedResources, resID)
 	}
-	// Set namespace of ServiceAccount references within a ClusterRoleBinding
-	if !namespaced && knownKind {
-		subjectsList, err := o.Pipe(yaml.Lookup("subjects"))
-		if err == nil {
-			subjects, err := subjectsList.Elements()
-			if err == nil {
-				for _, s := range subjects {
-					_ = s.PipeE(yaml.Lookup(yaml.NamespaceField), yaml.FieldSetter{StringValue: t.ForceNamespace})
-				}
+	// Set namespace of references to other resources
+	if t.ForceNamespace != "" {
+		for _, r := range namespaceRewriters {
+			if err = r.RewriteNamespace(o, &meta, t.ForceNamespace); err != nil {
+				return err
+			}
+		}
+		for _, f := range t.NamespaceReferences {
+			if err = fieldSpecRewriter(f).RewriteNamespace(o, &meta, t.ForceNamespace); err != nil {
+				return err
 			}
 		}
 	}
@@ -0,0 +1,183 @@
+package helm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/internal/matcher"
+	"github.com/mgoltzsche/khelm/v2/internal/resource"
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const duplicatesManifest = `---
+# Source: mychart/templates/a.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  namespace: ns1
+data:
+  a: a
+---
+# Source: mychart/templates/b.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+data:
+  c: c
+---
+# Source: mychart/templates/c.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  namespace: ns2
+data:
+  b: b
+`
+
+func TestTransformManifestDuplicates(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		policy   string
+		force    string
+		expected []string
+	}{
+		{"default without duplicates", "", "", []string{"ns1/myconfig", "/other", "ns2/myconfig"}},
+		{"fail without duplicates", config.DuplicatePolicyFail, "", []string{"ns1/myconfig", "/other", "ns2/myconfig"}},
+		{"keepFirst", config.DuplicatePolicyKeepFirst, "forced", []string{"  a: a\n", "  c: c\n"}},
+		{"keepLast", config.DuplicatePolicyKeepLast, "forced", []string{"  b: b\n", "  c: c\n"}},
+		{"merge", config.DuplicatePolicyMerge, "forced", []string{"  a: a\n  b: b\n", "  c: c\n"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testee := manifestTransformer{
+				ForceNamespace:  c.force,
+				Includes:        matcher.Any(),
+				Excludes:        matcher.FromResourceSelectors(nil),
+				DuplicatePolicy: c.policy,
+			}
+			r, err := testee.TransformManifest(strings.NewReader(duplicatesManifest))
+			require.NoError(t, err)
+			if c.force == "" {
+				ids := make([]string, len(r))
+				for i, o := range r {
+					ids[i] = o.GetNamespace() + "/" + o.GetName()
+				}
+				require.Equal(t, c.expected, ids, "resources")
+				return
+			}
+			require.Equal(t, 2, len(r), "resources")
+			for i, o := range r {
+				require.Contains(t, o.MustString(), c.expected[i], "resource %d", i)
+			}
+		})
+	}
+}
+
+func TestTransformManifestDuplicatesError(t *testing.T) {
+	testee := manifestTransformer{
+		ForceNamespace: "forced",
+		Includes:       matcher.Any(),
+		Excludes:       matcher.FromResourceSelectors(nil),
+	}
+	_, err := testee.TransformManifest(strings.NewReader(duplicatesManifest))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mychart/templates/a.yaml and mychart/templates/c.yaml")
+}
+
+func TestTransformManifestDuplicatesWithinReleaseNamespace(t *testing.T) {
+	manifest := `---
+# Source: mychart/templates/a.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+---
+# Source: mychart/templates/b.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: myconfig
+  namespace: release-ns
+`
+	testee := manifestTransformer{
+		Namespace: "release-ns",
+		Includes:  matcher.Any(),
+		Excludes:  matcher.FromResourceSelectors(nil),
+	}
+	_, err := testee.TransformManifest(strings.NewReader(manifest))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mychart/templates/a.yaml and mychart/templates/b.yaml")
+}
+
+func TestSourceTemplate(t *testing.T) {
+	manifest := "---\n# Source: mychart/templates/a.yaml\n# some comment\napiVersion: v1\nkind: ConfigMap\n---\napiVersion: v1\nkind: ConfigMap\n"
+	dec := yaml.NewDecoder(bytes.NewReader([]byte(manifest)))
+	sources := []string{}
+	for {
+		n := yaml.Node{}
+		if err := dec.Decode(&n); err != nil {
+			break
+		}
+		sources = append(sources, resource.SourceTemplate(yaml.NewRNode(&n)))
+	}
+	require.Equal(t, []string{"mychart/templates/a.yaml", ""}, sources)
+}
+
+func TestTransformManifestNamespaceReferences(t *testing.T) {
+	manifest := `---
+apiVersion: admissionregistration.k8s.io/v1
+kind: MutatingWebhookConfiguration
+metadata:
+  name: mywebhook
+webhooks:
+- name: a.example.org
+  clientConfig:
+    service:
+      name: mywebhook
+      namespace: original
+- name: b.example.org
+  clientConfig:
+    url: https://example.org
+---
+apiVersion: apiregistration.k8s.io/v1
+kind: APIService
+metadata:
+  name: v1.example.org
+spec:
+  service:
+    name: myapiserver
+    namespace: original
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: myrolebinding
+subjects:
+- kind: ServiceAccount
+  name: myserviceaccount
+  namespace: original
+- kind: Group
+  name: mygroup
+`
+	testee := manifestTransformer{
+		ForceNamespace:  "forced",
+		CreateNamespace: "forced",
+		NamespaceLabels: map[string]string{"example.org/managed": "true"},
+		Includes:        matcher.Any(),
+		Excludes:        matcher.FromResourceSelectors(nil),
+	}
+	r, err := testee.TransformManifest(strings.NewReader(manifest))
+	require.NoError(t, err)
+	require.Equal(t, 4, len(r), "resources")
+	require.Equal(t, "apiVersion: v1\nkind: Namespace\nmetadata:\n  labels:\n    example.org/managed: \"true\"\n  name: forced\n", r[0].MustString())
+	require.Contains(t, r[1].MustString(), "      name: mywebhook\n      namespace: forced\n")
+	require.Contains(t, r[1].MustString(), "    url: https://example.org\n")
+	require.Contains(t, r[2].MustString(), "    name: myapiserver\n    namespace: forced\n")
+	require.Contains(t, r[3].MustString(), "  name: myserviceaccount\n  namespace: forced\n- kind: Group\n  name: mygroup\n")
+	require.NotContains(t, r[3].MustString(), "original")
+}
@@ -0,0 +1,122 @@
+package helm
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/registry"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// TrustActionAllow makes the repositories that match a trust rule trusted
+	TrustActionAllow = "allow"
+	// TrustActionDeny rejects the repositories that match a trust rule
+	TrustActionDeny = "deny"
+)
+
+// TrustPolicy specifies which repositories and OCI registries can be used to load charts and their dependencies.
+// The first matching rule decides whether a repository can be used.
+// When no rule matches, repositories that are registered within repositories.yaml as well as OCI registries
+// are trusted and others only if usage of untrusted repositories is enabled.
+// Therefore, in order to restrict OCI registries, a policy must end with a catch-all deny rule.
+type TrustPolicy struct {
+	Charts       []TrustRule `json:"charts,omitempty"`
+	Dependencies []TrustRule `json:"dependencies,omitempty"`
+}
+
+// TrustRule allows or denies repositories by URL pattern or OCI registries by host pattern.
+// Within a pattern '*' matches any sequence of characters.
+// URL patterns match repository URLs as well as OCI chart references (oci://<host>/<path>).
+type TrustRule struct {
+	URL      string `json:"url,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Action   string `json:"action"`
+}
+
+// LoadTrustPolicy loads a trust policy from a YAML file.
+func LoadTrustPolicy(file string) (*TrustPolicy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "load trust policy")
+	}
+	p := &TrustPolicy{}
+	if err = yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, errors.Wrapf(err, "load trust policy from %s", file)
+	}
+	for _, rules := range [][]TrustRule{p.Charts, p.Dependencies} {
+		if err = trustRules(rules).validate(); err != nil {
+			return nil, errors.Wrapf(err, "load trust policy from %s", file)
+		}
+	}
+	return p, nil
+}
+
+func (p *TrustPolicy) chartRules() trustRules {
+	if p == nil {
+		return nil
+	}
+	return p.Charts
+}
+
+func (p *TrustPolicy) dependencyRules() trustRules {
+	if p == nil {
+		return nil
+	}
+	return p.Dependencies
+}
+
+type trustRules []TrustRule
+
+func (r trustRules) validate() error {
+	for _, rule := range r {
+		if rule.URL == "" && rule.Registry == "" || rule.URL != "" && rule.Registry != "" {
+			return errors.Errorf("trust rule must specify either url or registry")
+		}
+		if rule.Action != TrustActionAllow && rule.Action != TrustActionDeny {
+			return errors.Errorf("unsupported trust rule action %q, expected %s or %s", rule.Action, TrustActionAllow, TrustActionDeny)
+		}
+	}
+	return nil
+}
+
+// String returns a human-readable representation of the rule.
+func (r TrustRule) String() string {
+	if r.Registry != "" {
+		return fmt.Sprintf("%s registry %q", r.Action, r.Registry)
+	}
+	return fmt.Sprintf("%s url %q", r.Action, r.URL)
+}
+
+// evaluate returns the first rule that matches the given repository URL or OCI reference or nil if none matches.
+func (r trustRules) evaluate(repoURL string) *TrustRule {
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	host := ""
+	if registry.IsOCI(repoURL) {
+		host = strings.SplitN(strings.TrimPrefix(repoURL, registry.OCIScheme+"://"), "/", 2)[0]
+	}
+	for i, rule := range r {
+		if rule.URL != "" && matchPattern(strings.TrimSuffix(rule.URL, "/"), repoURL) ||
+			rule.Registry != "" && host != "" && matchPattern(rule.Registry, host) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// checkOCI returns an untrusted repository error if the given OCI chart reference is denied.
+// OCI registries that no rule matches are trusted.
+func (r trustRules) checkOCI(ref string) error {
+	if rule := r.evaluate(ref); rule != nil && rule.Action == TrustActionDeny {
+		return &untrustedRepoError{errors.Errorf("OCI chart %q is denied by trust rule %s", ref, rule), true}
+	}
+	return nil
+}
+
+func matchPattern(pattern, s string) bool {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	return regexp.MustCompile("^" + expr + "$").MatchString(s)
+}
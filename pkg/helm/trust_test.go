@@ -0,0 +1,134 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestTrustRulesEvaluate(t *testing.T) {
+	rules := trustRules{
+		{URL: "https://charts.example.org/private/*", Action: TrustActionDeny},
+		{URL: "https://charts.example.org/*", Action: TrustActionAllow},
+		{Registry: "*.example.org", Action: TrustActionAllow},
+		{URL: "oci://ghcr.io/myorg/*", Action: TrustActionAllow},
+		{Registry: "ghcr.io", Action: TrustActionDeny},
+	}
+	for _, c := range []struct {
+		url     string
+		allow   bool
+		matched bool
+	}{
+		{"https://charts.example.org/stable/", true, true},
+		{"https://charts.example.org/private/x", false, true},
+		{"https://other.example.org", false, false},
+		{"oci://registry.example.org/charts/mychart", true, true},
+		{"oci://ghcr.io/myorg/mychart", true, true},
+		{"oci://ghcr.io/other/mychart", false, true},
+		{"oci://docker.io/other/mychart", false, false},
+	} {
+		rule := rules.evaluate(c.url)
+		require.Equal(t, c.matched, rule != nil, "matched(%s)", c.url)
+		require.Equal(t, c.allow, rule != nil && rule.Action == TrustActionAllow, "allow(%s)", c.url)
+	}
+	// OCI registries that no rule matches are trusted unless the rules end with a catch-all deny rule
+	allowOnly := trustRules{{Registry: "*.example.org", Action: TrustActionAllow}}
+	require.NoError(t, allowOnly.checkOCI("oci://ghcr.io/other/mychart"), "allow-only rules")
+	err := append(allowOnly, TrustRule{URL: "*", Action: TrustActionDeny}).checkOCI("oci://ghcr.io/other/mychart")
+	require.Error(t, err, "catch-all deny rule")
+	require.True(t, IsDeniedRepository(err), "IsDeniedRepository(%q)", err)
+	require.Contains(t, err.Error(), `deny url "*"`, "error should name the rule")
+	require.NoError(t, append(allowOnly, TrustRule{URL: "*", Action: TrustActionDeny}).checkOCI("oci://registry.example.org/mychart"), "allowed before catch-all deny rule")
+	require.Error(t, trustRules{{URL: "x", Registry: "y", Action: TrustActionAllow}}.validate(), "url and registry")
+	require.Error(t, trustRules{{URL: "x", Action: "trust"}}.validate(), "invalid action")
+}
+
+func TestRenderTrustPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "khelm-test-trust-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	ch, err := loader.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	fakeChartTgz, err := chartutil.Save(ch, tmpDir)
+	require.NoError(t, err)
+	origHelmHome := os.Getenv("HELM_HOME")
+	err = os.Setenv("HELM_HOME", tmpDir)
+	require.NoError(t, err)
+	defer os.Setenv("HELM_HOME", origHelmHome)
+	err = os.Mkdir(filepath.Join(tmpDir, "repository"), 0755)
+	require.NoError(t, err)
+	err = repo.NewFile().WriteFile(filepath.Join(tmpDir, "repository", "repositories.yaml"), 0644)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name    string
+		chart   string
+		rules   func(repoURL string) *TrustPolicy
+		trusted bool
+		denied  bool
+	}{
+		{"allow unregistered repository", "", func(u string) *TrustPolicy {
+			return &TrustPolicy{Charts: []TrustRule{{URL: u, Action: TrustActionAllow}}}
+		}, true, false},
+		{"deny repository", "", func(u string) *TrustPolicy {
+			return &TrustPolicy{Charts: []TrustRule{{URL: "*", Action: TrustActionDeny}}}
+		}, false, true},
+		{"dependency rules do not apply to chart", "", func(u string) *TrustPolicy {
+			return &TrustPolicy{Charts: []TrustRule{{URL: u, Action: TrustActionAllow}}, Dependencies: []TrustRule{{URL: "*", Action: TrustActionDeny}}}
+		}, true, false},
+		{"unregistered repository", "", func(string) *TrustPolicy { return &TrustPolicy{} }, false, false},
+		{"deny OCI registry", "oci://ghcr.io/myorg/mychart", func(string) *TrustPolicy {
+			return &TrustPolicy{Charts: []TrustRule{{Registry: "ghcr.io", Action: TrustActionDeny}}}
+		}, false, true},
+		{"allow-only policy with catch-all deny rule restricts OCI registries", "oci://ghcr.io/myorg/mychart", func(u string) *TrustPolicy {
+			return &TrustPolicy{Charts: []TrustRule{{URL: u, Action: TrustActionAllow}, {URL: "*", Action: TrustActionDeny}}}
+		}, false, true},
+		{"deny OCI dependency", filepath.Join(rootDir, "example", "oci-dependency"), func(string) *TrustPolicy {
+			return &TrustPolicy{Dependencies: []TrustRule{{Registry: "public.ecr.aws", Action: TrustActionDeny}}}
+		}, false, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := config.NewChartConfig()
+			cfg.Chart = "private-chart"
+			cfg.Name = "myrelease"
+			cfg.Version = fmt.Sprintf("0.0.%d", time.Now().UnixNano())
+			cfg.BaseDir = rootDir
+			entry := &repo.Entry{Name: "myprivaterepo", Username: "fakeuser", Password: "fakepassword"}
+			srv := httptest.NewServer(&fakePrivateChartServerHandler{entry, &cfg.LoaderConfig, fakeChartTgz, "0000000000000000"})
+			defer srv.Close()
+			entry.URL = srv.URL
+			cfg.Repository = srv.URL
+			if c.chart != "" {
+				cfg.Chart = c.chart
+				cfg.Repository = ""
+				cfg.Version = ""
+			}
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+			t.Setenv("KHELM_REPO_"+hostEnvName(u.Host)+"_USERNAME", entry.Username)
+			t.Setenv("KHELM_REPO_"+hostEnvName(u.Host)+"_PASSWORD", entry.Password)
+
+			h := NewHelm()
+			h.TrustPolicy = c.rules(srv.URL)
+			_, err = h.Render(context.Background(), cfg)
+			if c.trusted {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.True(t, IsUntrustedRepository(err), "IsUntrustedRepository(%q)", err)
+				require.Equal(t, c.denied, IsDeniedRepository(err), "IsDeniedRepository(%q)", err)
+			}
+		})
+	}
+}
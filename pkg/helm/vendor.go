@@ -0,0 +1,167 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+// Vendor loads the chart including its dependencies and writes it to the given destination.
+// The chart is written as archive if dest ends with .tgz, otherwise as directory that contains
+// the dependencies within its charts directory as well as the lock file.
+// The chart and its dependencies are verified when verification is enabled.
+// When the chart was loaded from an archive it is copied as is to an archive destination
+// along with its provenance file (if any) so that it can still be verified.
+// A chart that exists at the destination already is replaced.
+func (h *Helm) Vendor(ctx context.Context, req *config.ChartConfig, dest string) error {
+	if err := makeBaseDirAbsolute(req); err != nil {
+		return err
+	}
+	archive := strings.HasSuffix(dest, ".tgz")
+	if err := checkVendorDestination(dest, archive); err != nil {
+		return err
+	}
+	chartRequested, chartPath, err := h.locateAndLoadChart(ctx, req)
+	if err != nil {
+		return errors.Wrapf(err, "load chart %s", req.Chart)
+	}
+	destParentDir := filepath.Dir(dest)
+	if err = os.MkdirAll(destParentDir, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	tmpDir, err := os.MkdirTemp(destParentDir, ".tmp-khelm-vendor-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var file string
+	provFile := ""
+	if fi, e := os.Stat(chartPath); archive && e == nil && !fi.IsDir() {
+		// Keep the original archive since its provenance file refers to its digest
+		file = filepath.Join(tmpDir, filepath.Base(dest))
+		if err = copyFile(chartPath, file); err == nil {
+			provFile, err = copyProvenanceFile(chartPath, file, req.Verify)
+		}
+	} else if archive {
+		file, err = chartutil.Save(chartRequested, tmpDir)
+	} else {
+		file = filepath.Join(tmpDir, chartRequested.Name())
+		removeLocalDependencyRepositories(chartRequested)
+		if err = chartutil.SaveDir(chartRequested, tmpDir); err == nil {
+			err = writeLockFile(chartRequested, file)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "write chart %s", req.Chart)
+	}
+	if err = os.RemoveAll(dest); err != nil {
+		return errors.WithStack(err)
+	}
+	if archive {
+		if err = os.RemoveAll(dest + provenanceFileSuffix); err != nil {
+			return errors.WithStack(err)
+		}
+		if provFile != "" {
+			if err = os.Rename(provFile, dest+provenanceFileSuffix); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return errors.WithStack(os.Rename(file, dest))
+}
+
+// provenanceFileSuffix is appended to a chart archive's path to derive the path of its provenance file
+const provenanceFileSuffix = ".prov"
+
+// copyProvenanceFile copies the provenance file of the given chart archive next to the destination archive if it exists.
+// It returns the destination provenance file path or an empty string if the chart has no provenance file.
+// Since the provenance file refers to the archive by name it is only copied when the names match,
+// failing when verification is enabled and the names differ.
+func copyProvenanceFile(chartFile, destFile string, verify bool) (string, error) {
+	src := chartFile + provenanceFileSuffix
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+	if name := filepath.Base(chartFile); name != filepath.Base(destFile) {
+		if verify {
+			return "", errors.Errorf("the vendored chart archive must be named %s to be verifiable using its provenance file", name)
+		}
+		return "", nil
+	}
+	dest := destFile + provenanceFileSuffix
+	return dest, copyFile(src, dest)
+}
+
+// copyFile copies the given file's content to the destination path.
+func copyFile(src, dest string) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(dest, b, 0640))
+}
+
+// checkVendorDestination fails if the destination exists but does not contain a chart.
+func checkVendorDestination(dest string, archive bool) error {
+	fi, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	if archive {
+		if fi.IsDir() {
+			return errors.Errorf("vendor destination %s is a directory", dest)
+		}
+		return nil
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("vendor destination %s is not a directory", dest)
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil || len(entries) == 0 {
+		return errors.WithStack(err)
+	}
+	if _, err = os.Stat(filepath.Join(dest, chartutil.ChartfileName)); err != nil {
+		return errors.Errorf("refusing to overwrite vendor destination %s since it does not contain a chart", dest)
+	}
+	return nil
+}
+
+// removeLocalDependencyRepositories removes the file:// repository references from the chart's dependencies.
+// This is because the dependencies are contained within the vendored chart's charts directory
+// while the directories they refer to are not vendored.
+// The lock file is kept as is to document where the dependencies originate from.
+func removeLocalDependencyRepositories(c *chart.Chart) {
+	for _, dep := range c.Metadata.Dependencies {
+		if strings.HasPrefix(dep.Repository, "file://") {
+			dep.Repository = ""
+		}
+	}
+}
+
+// writeLockFile writes the chart's lock file into the given chart directory since chartutil.SaveDir doesn't.
+func writeLockFile(c *chart.Chart, dir string) error {
+	if c.Lock == nil {
+		return nil
+	}
+	b, err := yaml.Marshal(c.Lock)
+	if err != nil {
+		return errors.Wrap(err, "marshal lock file")
+	}
+	lockFile := "Chart.lock"
+	if c.Metadata.APIVersion == chart.APIVersionV1 {
+		lockFile = "requirements.lock"
+	}
+	return errors.WithStack(os.WriteFile(filepath.Join(dir, lockFile), b, 0640))
+}
@@ -0,0 +1,147 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mgoltzsche/khelm/v2/pkg/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp" //nolint
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+func TestVendor(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-vendor-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	chartDir := filepath.Join(dir, "umbrella")
+	err = os.MkdirAll(chartDir, 0750)
+	require.NoError(t, err)
+	chartYAML := fmt.Sprintf("apiVersion: v2\nname: umbrella\nversion: 0.1.0\ndependencies:\n- name: namespace\n  version: 0.1.0\n  repository: file://%s\n", filepath.Join(rootDir, "example", "namespace"))
+	err = os.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte(chartYAML), 0640)
+	require.NoError(t, err)
+	req := config.NewChartConfig()
+	req.Chart = chartDir
+	req.Name = "myrelease"
+	var expected bytes.Buffer
+	err = render(t, *req, false, &expected)
+	require.NoError(t, err)
+
+	for _, dest := range []string{"vendor/umbrella", "vendor/umbrella.tgz"} {
+		t.Run(dest, func(t *testing.T) {
+			dest = filepath.Join(dir, filepath.FromSlash(dest))
+			h := NewHelm()
+			for i := 0; i < 2; i++ {
+				req := config.NewChartConfig()
+				req.Chart = chartDir
+				err = h.Vendor(context.Background(), req, dest)
+				require.NoError(t, err, "vendor (%d)", i)
+			}
+			if filepath.Ext(dest) != ".tgz" {
+				_, err = os.Stat(filepath.Join(dest, "Chart.lock"))
+				require.NoError(t, err, "Chart.lock")
+				_, err = os.Stat(filepath.Join(dest, "charts", "namespace-0.1.0.tgz"))
+				require.NoError(t, err, "dependency archive")
+			}
+			req := config.NewChartConfig()
+			req.Chart = dest
+			req.Name = "myrelease"
+			var actual bytes.Buffer
+			err = render(t, *req, false, &actual)
+			require.NoError(t, err)
+			require.Equal(t, expected.String(), actual.String(), "output of vendored chart")
+		})
+	}
+
+	otherDir := filepath.Join(dir, "other")
+	err = os.MkdirAll(otherDir, 0750)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(otherDir, "file"), []byte("x"), 0640)
+	require.NoError(t, err)
+	req.Chart = chartDir
+	err = NewHelm().Vendor(context.Background(), req, otherDir)
+	require.Error(t, err, "should not overwrite a directory that does not contain a chart")
+}
+
+func TestRenderLocalChartArchive(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-archive-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dep, err := loader.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	umbrella := &chart.Chart{Metadata: &chart.Metadata{
+		APIVersion: chart.APIVersionV2,
+		Name:       "umbrella",
+		Version:    "0.1.0",
+		// The repository cannot be resolved: the archive must be rendered using the dependency it contains
+		Dependencies: []*chart.Dependency{{Name: "namespace", Version: "0.1.0", Repository: "file://../missing"}},
+	}}
+	umbrella.AddDependency(dep)
+	archive, err := chartutil.Save(umbrella, dir)
+	require.NoError(t, err)
+	req := config.NewChartConfig()
+	req.Chart = archive
+	req.Name = "myrelease"
+	var buf bytes.Buffer
+	err = render(t, *req, false, &buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "kind: ConfigMap")
+}
+
+func TestVendorArchiveProvenance(t *testing.T) {
+	dir, err := os.MkdirTemp("", "khelm-vendor-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ch, err := loader.Load(filepath.Join(rootDir, "example", "namespace"))
+	require.NoError(t, err)
+	archive, err := chartutil.Save(ch, dir)
+	require.NoError(t, err)
+	entity, err := openpgp.NewEntity("khelm test", "", "test@example.org", nil)
+	require.NoError(t, err)
+	keyring := filepath.Join(dir, "pubring.gpg")
+	f, err := os.Create(keyring)
+	require.NoError(t, err)
+	err = entity.Serialize(f)
+	require.NoError(t, err)
+	err = f.Close()
+	require.NoError(t, err)
+	signatory := &provenance.Signatory{Entity: entity, KeyRing: openpgp.EntityList{entity}}
+	sig, err := signatory.ClearSign(archive)
+	require.NoError(t, err)
+	err = os.WriteFile(archive+".prov", []byte(sig), 0640)
+	require.NoError(t, err)
+
+	req := config.NewChartConfig()
+	req.Chart = archive
+	req.Verify = true
+	req.Keyring = keyring
+	err = NewHelm().Vendor(context.Background(), req, filepath.Join(dir, "vendor", "namespace.tgz"))
+	require.Error(t, err, "vendor verified chart into archive with a different name")
+	dest := filepath.Join(dir, "vendor", filepath.Base(archive))
+	err = NewHelm().Vendor(context.Background(), req, dest)
+	require.NoError(t, err)
+	b, err := os.ReadFile(dest + ".prov")
+	require.NoError(t, err, "vendored provenance file")
+	require.Equal(t, sig, string(b), "vendored provenance file")
+
+	req = config.NewChartConfig()
+	req.Chart = dest
+	req.Name = "myrelease"
+	req.Verify = true
+	req.Keyring = keyring
+	err = render(t, *req, false, &bytes.Buffer{})
+	require.NoError(t, err, "render vendored chart with verification")
+
+	err = os.WriteFile(dest+".prov", []byte(strings.Replace(sig, "namespace", "other", 1)), 0640)
+	require.NoError(t, err)
+	err = render(t, *req, false, &bytes.Buffer{})
+	require.Error(t, err, "render vendored chart with invalid provenance file")
+}